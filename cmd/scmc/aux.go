@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 const (
@@ -61,3 +67,51 @@ func oxfordJoin(values []string, format string, w string) string {
 
 	return s.String()
 }
+
+// credentials returns the myCloud username and password to use for the given
+// command. The flags "username" and "password" take precedence over the
+// configuration file, which takes precedence over the flags' default values
+// ($MYCLOUD_USERNAME and $MYCLOUD_PASSWORD). Missing values are prompted for.
+func credentials(cmd *cobra.Command, username string, password string) (string, string, error) {
+	username, password = configCredentials(cmd, username, password)
+
+	if username == "" {
+		fmt.Fprint(os.Stderr, "Swisscom myCloud username: ")
+
+		u, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return "", "", fmt.Errorf("reader.ReadString: %v", err)
+		}
+
+		username = strings.TrimSpace(u)
+	}
+
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Swisscom myCloud password: ")
+
+		p, err := terminal.ReadPassword(int(syscall.Stdin))
+		if err != nil {
+			return "", "", fmt.Errorf("terminal.ReadPassword: %v", err)
+		}
+
+		password = string(p)
+		fmt.Fprintln(os.Stderr)
+	}
+
+	return username, password, nil
+}
+
+// configCredentials returns the username and password from the flags
+// "username" and "password" if set, otherwise from the configuration file, or
+// the given defaults (e.g. from the environment) if neither is set.
+func configCredentials(cmd *cobra.Command, username string, password string) (string, string) {
+	if !cmd.Flags().Changed("username") && cfg.Username != "" {
+		username = cfg.Username
+	}
+
+	if !cmd.Flags().Changed("password") && cfg.Password != "" {
+		password = cfg.Password
+	}
+
+	return username, password
+}
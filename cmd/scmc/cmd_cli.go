@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -9,8 +10,10 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,6 +22,7 @@ import (
 	"github.com/c-bata/go-prompt"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -197,42 +201,665 @@ func upload(p string) error {
 	return fmt.Errorf("invalid filetype: %v", p)
 }
 
-func download(p string) error {
-	metadata, err := mc.Metadata(p)
+// GetOptions represents options for the cli command "get".
+type GetOptions struct {
+	Overwrite bool
+	Skip      bool
+	Newer     bool
+}
+
+var getOptions GetOptions
+
+// remoteEntry represents a remote file or directory.
+type remoteEntry struct {
+	Name             string
+	Dir              bool
+	Length           uint64
+	Etag             string
+	ModificationTime time.Time
+}
+
+// remoteStat returns the remote file or directory p by listing its parent
+// directory.
+func remoteStat(p string) (*remoteEntry, error) {
+	p = path.Clean(p)
+
+	if p == "/" {
+		return &remoteEntry{Name: "/", Dir: true}, nil
+	}
+
+	metadata, err := mc.Metadata(path.Dir(p) + "/")
+	if err != nil {
+		return nil, fmt.Errorf("mc.Metadata(%s): %v", path.Dir(p)+"/", err)
+	}
+
+	name := path.Base(p)
+
+	for _, d := range metadata.Directories {
+		if d.Name == name {
+			return &remoteEntry{Name: d.Name, Dir: true, ModificationTime: d.ModificationTime}, nil
+		}
+	}
+
+	for _, f := range metadata.Files {
+		if f.Name == name {
+			return &remoteEntry{Name: f.Name, Length: f.Length, Etag: f.Etag, ModificationTime: f.ModificationTime}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: no such file or directory", p)
+}
+
+// transferStats represents the summary of a transfer.
+type transferStats struct {
+	start   time.Time
+	files   int
+	dirs    int
+	skipped int
+	failed  int
+	bytes   uint64
+}
+
+func (s *transferStats) String() string {
+	d := time.Since(s.start)
+	rate := float64(s.bytes) / d.Seconds()
+
+	return fmt.Sprintf("%d files and %d directories downloaded (%s in %s, %s/s), %d skipped, %d failed",
+		s.files, s.dirs, bytesToSize(s.bytes), d.Round(time.Millisecond), bytesToSize(uint64(rate)), s.skipped, s.failed)
+}
+
+// downloadDir downloads the remote directory rp and all of its contents to
+// the local directory lp. Errors of single files are reported and counted,
+// but do not abort the download of the remaining files.
+func downloadDir(rp string, lp string, mtime time.Time, stats *transferStats) error {
+	metadata, err := mc.Metadata(strings.TrimSuffix(rp, "/") + "/")
 	if err != nil {
-		return fmt.Errorf("mc.Metadata(%s): %v", p, err)
+		return fmt.Errorf("mc.Metadata(%s): %v", rp, err)
+	}
+
+	if err := os.MkdirAll(lp, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll(%s): %v", lp, err)
 	}
 
-	// TODO
+	for _, d := range metadata.Directories {
+		if err := downloadDir(path.Join(rp, d.Name), filepath.Join(lp, d.Name), d.ModificationTime, stats); err != nil {
+			fmt.Fprintf(os.Stderr, "downloadDir(%s): %v\n", path.Join(rp, d.Name), err)
+			stats.failed++
+		}
+	}
+
+	for _, f := range metadata.Files {
+		e := &remoteEntry{Name: f.Name, Length: f.Length, Etag: f.Etag, ModificationTime: f.ModificationTime}
+
+		if err := downloadFile(path.Join(rp, f.Name), filepath.Join(lp, f.Name), e, stats); err != nil {
+			fmt.Fprintf(os.Stderr, "downloadFile(%s): %v\n", path.Join(rp, f.Name), err)
+			stats.failed++
+		}
+	}
+
+	stats.dirs++
+
+	// Set the modification time last, since creating its contents changes it.
+	if !mtime.IsZero() {
+		if err := os.Chtimes(lp, mtime, mtime); err != nil {
+			return fmt.Errorf("os.Chtimes(%s): %v", lp, err)
+		}
+	}
 
-	fmt.Printf("%v\n", metadata.Directories)
-	fmt.Printf("%v\n", metadata.Files)
 	return nil
 }
 
+// downloadFile downloads the remote file rp to the local file lp. The file
+// is written to a temporary file first, which replaces lp once the download
+// has completed.
+func downloadFile(rp string, lp string, e *remoteEntry, stats *transferStats) error {
+	if st, err := os.Stat(lp); err == nil {
+		switch o := getOptions; {
+		case st.IsDir():
+			return fmt.Errorf("%s is a directory", lp)
+		case o.Skip:
+			fmt.Fprintf(os.Stderr, "skipping '%s' (exists)\n", lp)
+			stats.skipped++
+			return nil
+		case o.Newer && !e.ModificationTime.After(st.ModTime()):
+			fmt.Fprintf(os.Stderr, "skipping '%s' (not older than '%s')\n", lp, rp)
+			stats.skipped++
+			return nil
+		case !o.Overwrite && !o.Newer:
+			return fmt.Errorf("%s exists (use --overwrite, --skip or --newer)", lp)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("os.Stat(%s): %v", lp, err)
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(lp), "."+filepath.Base(lp)+".")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %v", err)
+	}
+
+	defer os.Remove(file.Name())
+
+	fmt.Fprintf(os.Stderr, "'%s' -> '%s'\n", rp, lp)
+
+	bar := pb.New64(int64(e.Length))
+	bar.SetRefreshRate(time.Second)
+	bar.SetWriter(os.Stderr)
+
+	writer := bar.NewProxyWriter(file)
+
+	bar.Start()
+
+	if err := mc.GetFile(rp, writer, ""); err != nil {
+		bar.Finish()
+		file.Close()
+		return fmt.Errorf("mc.GetFile(%s): %v", rp, err)
+	}
+
+	bar.Finish()
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("file.Close: %v", err)
+	}
+
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return fmt.Errorf("os.Chmod(%s): %v", file.Name(), err)
+	}
+
+	if err := os.Chtimes(file.Name(), e.ModificationTime, e.ModificationTime); err != nil {
+		return fmt.Errorf("os.Chtimes(%s): %v", file.Name(), err)
+	}
+
+	if err := os.Rename(file.Name(), lp); err != nil {
+		return fmt.Errorf("os.Rename(%s, %s): %v", file.Name(), lp, err)
+	}
+
+	stats.files++
+	stats.bytes += e.Length
+
+	return nil
+}
+
+// download downloads a single remote file or a directory and all of its
+// contents into the current local directory.
+func download(p string, stats *transferStats) error {
+	rp := path.Join(rpwd, p)
+
+	e, err := remoteStat(rp)
+	if err != nil {
+		return err
+	}
+
+	lp := filepath.Join(lpwd, e.Name)
+
+	if e.Dir {
+		if rp == "/" {
+			lp = lpwd
+		}
+
+		return downloadDir(rp, lp, e.ModificationTime, stats)
+	}
+
+	return downloadFile(rp, lp, e, stats)
+}
+
+// ask prints question and reads a single-character answer from the terminal
+// until it is one of choices. If standard input is not a terminal, def is
+// returned, since standard input carries the commands.
+func ask(question string, choices string, def byte) byte {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return def
+	}
+
+	for {
+		fmt.Fprintf(os.Stderr, "%s ", question)
+
+		answer, err := readLine()
+		if err != nil {
+			return def
+		}
+
+		if answer = strings.ToLower(strings.TrimSpace(answer)); len(answer) == 1 && strings.Contains(choices, answer) {
+			return answer[0]
+		}
+	}
+}
+
+// readLine reads a line from standard input one byte at a time, so that no
+// input following the line, which is meant for the prompt, is consumed.
+func readLine() (string, error) {
+	var (
+		line []byte
+		b    = make([]byte, 1)
+	)
+
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+
+			line = append(line, b[0])
+		}
+
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+// hashFile returns the SHA256 hash of the local file p.
+func hashFile(p string) ([]byte, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open(%s): %v", p, err)
+	}
+
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, fmt.Errorf("io.Copy: %v", err)
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// backupFile copies the local file p to "<name>.<timestamp>.bak" in the
+// current local directory and returns the name of the copy.
+func backupFile(p string, name string) (string, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("os.Open(%s): %v", p, err)
+	}
+
+	defer src.Close()
+
+	bp := filepath.Join(lpwd, fmt.Sprintf("%s.%s.bak", name, time.Now().Format("20060102-150405")))
+
+	dst, err := os.OpenFile(bp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("os.OpenFile(%s): %v", bp, err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", fmt.Errorf("io.Copy: %v", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return "", fmt.Errorf("dst.Close: %v", err)
+	}
+
+	return bp, nil
+}
+
+// edit downloads the remote file p to a temporary file, opens it in the
+// editor specified in $EDITOR and uploads it again if it has been changed.
+// Before uploading, the remote file is checked for modifications made in the
+// meantime. If the file is not uploaded, a backup copy is kept locally.
+func edit(p string) error {
+	e, err := remoteStat(p)
+	if err != nil {
+		return err
+	}
+
+	if e.Dir {
+		return fmt.Errorf("%s is a directory", p)
+	}
+
+	// Keep the extension, editors use it to detect the file type.
+	file, err := ioutil.TempFile("", "scmc-*"+path.Ext(p))
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %v", err)
+	}
+
+	keep := false
+
+	defer func() {
+		if keep {
+			fmt.Fprintf(os.Stderr, "the edited file has been kept at '%s'\n", file.Name())
+			return
+		}
+
+		if err := os.Remove(file.Name()); err != nil {
+			fmt.Fprintf(os.Stderr, "os.Remove: %v\n", err)
+		}
+	}()
+
+	hasher := sha256.New()
+	mw := io.MultiWriter(hasher, file)
+
+	if err := mc.GetFile(p, mw, ""); err != nil {
+		file.Close()
+		return fmt.Errorf("mc.GetFile(%s): %v", p, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("file.Close: %v", err)
+	}
+
+	originalHash := hasher.Sum(nil)
+
+	editor, ok := os.LookupEnv("EDITOR")
+	if !ok {
+		editor = "vi"
+	}
+
+	c := exec.Command(editor, file.Name())
+	c.Stdout = os.Stdout
+	c.Stdin = os.Stdin
+	c.Stderr = os.Stderr
+
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("c.Run: %v", err)
+	}
+
+	hash, err := hashFile(file.Name())
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(hash, originalHash) {
+		fmt.Fprintf(os.Stderr, "'%s' not modified\n", p)
+		return nil
+	}
+
+	// backup keeps a copy of the edited file, or the temporary file itself if
+	// that fails.
+	backup := func() {
+		bp, err := backupFile(file.Name(), e.Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "backupFile: %v\n", err)
+			keep = true
+			return
+		}
+
+		fmt.Fprintf(os.Stderr, "backup copy saved as '%s'\n", bp)
+	}
+
+	conflict := true
+
+	if current, err := remoteStat(p); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to check '%s' for remote modifications: %v\n", p, err)
+	} else if current.Etag != e.Etag || !current.ModificationTime.Equal(e.ModificationTime) {
+		fmt.Fprintf(os.Stderr, "'%s' has been modified remotely since it was downloaded (%s)\n", p, current.ModificationTime.Local().Format("2006-01-02 15:04:05"))
+	} else {
+		conflict = false
+	}
+
+	if conflict && ask("[o]verwrite remote file or [k]eep local copy only?", "ok", 'k') == 'k' {
+		backup()
+		return nil
+	}
+
+	reader, err := os.Open(file.Name())
+	if err != nil {
+		backup()
+		return fmt.Errorf("os.Open(%s): %v", file.Name(), err)
+	}
+
+	defer reader.Close()
+
+	st, err := reader.Stat()
+	if err != nil {
+		backup()
+		return fmt.Errorf("reader.Stat: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "'%s' -> '%s'\n", file.Name(), p)
+
+	bar := pb.New64(st.Size())
+	bar.SetRefreshRate(time.Second)
+	bar.SetWriter(os.Stderr)
+
+	bar.Start()
+
+	if err := mc.CreateFile(p, bar.NewProxyReader(reader)); err != nil {
+		bar.Finish()
+		backup()
+		return fmt.Errorf("mc.CreateFile(%s): %v", p, err)
+	}
+
+	bar.Finish()
+
+	return nil
+}
+
+// resetFlags resets the flags of all cli commands to their default values,
+// since the commands are executed repeatedly.
+func resetFlags(c *cobra.Command) {
+	c.Flags().VisitAll(func(f *pflag.Flag) {
+		f.Value.Set(f.DefValue)
+		f.Changed = false
+	})
+
+	for _, sc := range c.Commands() {
+		resetFlags(sc)
+	}
+}
+
 func executor(s string) {
 	if s = strings.TrimSpace(s); s != "" {
+		resetFlags(cmd)
 		cmd.SetArgs(strings.Fields(s))
 		cmd.Execute()
+
+		// Commands may change remote directories.
+		clearListCache()
+	}
+}
+
+// listCacheTTL is the duration for which remote directory listings are
+// cached for completion.
+const listCacheTTL = 10 * time.Second
+
+// completion represents what the arguments of a cli command are completed
+// with.
+type completion int
+
+const (
+	completeRemote completion = iota
+	completeRemoteDirs
+	completeLocal
+	completeLocalDirs
+	completeCommands
+)
+
+// completions maps cli commands to the completion of their arguments.
+// Commands which are not listed take no arguments.
+var completions = map[string]completion{
+	"cd":     completeRemoteDirs,
+	"get":    completeRemote,
+	"cat":    completeRemote,
+	"sha256": completeRemote,
+	"mkdir":  completeRemoteDirs,
+	"rm":     completeRemote,
+	"rmdir":  completeRemoteDirs,
+	"edit":   completeRemote,
+	"lcd":    completeLocalDirs,
+	"put":    completeLocal,
+	"ledit":  completeLocal,
+	"help":   completeCommands,
+}
+
+// listCache caches remote directory listings for completion, since the
+// completer runs on every key press.
+var listCache = struct {
+	sync.Mutex
+	entries map[string]listCacheEntry
+}{entries: map[string]listCacheEntry{}}
+
+type listCacheEntry struct {
+	time    time.Time
+	entries []prompt.Suggest
+	err     error
+}
+
+// remoteList returns the entries of the remote directory dir, directories
+// with a trailing slash. Errors are cached as well, so that typing a path
+// which does not exist does not request it on every key press.
+func remoteList(dir string) ([]prompt.Suggest, error) {
+	listCache.Lock()
+	c, ok := listCache.entries[dir]
+	listCache.Unlock()
+
+	if ok && time.Since(c.time) < listCacheTTL {
+		return c.entries, c.err
+	}
+
+	c = listCacheEntry{time: time.Now()}
+
+	metadata, err := mc.Metadata(dir)
+	if err != nil {
+		c.err = err
+	} else {
+		for _, d := range metadata.Directories {
+			c.entries = append(c.entries, prompt.Suggest{Text: d.Name + "/", Description: "directory"})
+		}
+
+		for _, f := range metadata.Files {
+			c.entries = append(c.entries, prompt.Suggest{Text: f.Name, Description: bytesToSize(f.Length)})
+		}
+	}
+
+	listCache.Lock()
+	listCache.entries[dir] = c
+	listCache.Unlock()
+
+	return c.entries, c.err
+}
+
+// clearListCache empties the cache of remote directory listings.
+func clearListCache() {
+	listCache.Lock()
+	listCache.entries = map[string]listCacheEntry{}
+	listCache.Unlock()
+}
+
+// localList returns the entries of the local directory dir, directories
+// with a trailing slash.
+func localList(dir string) ([]prompt.Suggest, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []prompt.Suggest
+
+	for _, f := range files {
+		if f.IsDir() {
+			entries = append(entries, prompt.Suggest{Text: f.Name() + "/", Description: "directory"})
+		} else {
+			entries = append(entries, prompt.Suggest{Text: f.Name(), Description: bytesToSize(uint64(f.Size()))})
+		}
+	}
+
+	return entries, nil
+}
+
+// completePath returns the entries of the directory of word which start with
+// its base name, prefixed with the directory, so that they replace word.
+func completePath(word string, c completion) []prompt.Suggest {
+	var (
+		entries []prompt.Suggest
+		err     error
+	)
+
+	i := strings.LastIndex(word, "/") + 1
+	dir, base := word[:i], word[i:]
+
+	switch c {
+	case completeRemote, completeRemoteDirs:
+		entries, err = remoteList(strings.TrimSuffix(path.Join(rpwd, dir), "/") + "/")
+	case completeLocal, completeLocalDirs:
+		if dir == "" {
+			entries, err = localList(lpwd)
+		} else if filepath.IsAbs(dir) {
+			entries, err = localList(dir)
+		} else {
+			entries, err = localList(filepath.Join(lpwd, dir))
+		}
 	}
+
+	if err != nil {
+		return nil
+	}
+
+	var s []prompt.Suggest
+
+	for _, e := range entries {
+		if (c == completeRemoteDirs || c == completeLocalDirs) && !strings.HasSuffix(e.Text, "/") {
+			continue
+		}
+
+		// Hidden files are only suggested if explicitly asked for.
+		if strings.HasPrefix(e.Text, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		if strings.HasPrefix(e.Text, base) {
+			s = append(s, prompt.Suggest{Text: dir + e.Text, Description: e.Description})
+		}
+	}
+
+	return s
+}
+
+// completeCommand returns the cli commands which start with word.
+func completeCommand(word string) []prompt.Suggest {
+	var s []prompt.Suggest
+
+	for _, c := range cmd.Commands() {
+		if !c.Hidden {
+			s = append(s, prompt.Suggest{Text: c.Name(), Description: c.Short})
+		}
+	}
+
+	return prompt.FilterHasPrefix(s, word, true)
 }
 
+// completeFlag returns the flags of the cli command c which start with word.
+func completeFlag(c *cobra.Command, word string) []prompt.Suggest {
+	var s []prompt.Suggest
+
+	c.Flags().VisitAll(func(f *pflag.Flag) {
+		if !f.Hidden {
+			s = append(s, prompt.Suggest{Text: "--" + f.Name, Description: f.Usage})
+		}
+	})
+
+	return prompt.FilterHasPrefix(s, word, true)
+}
+
+// completer completes command names for the first word, and flags, remote
+// or local paths for the arguments, depending on the command.
 func completer(d prompt.Document) []prompt.Suggest {
-	s := []prompt.Suggest{
-		{Text: "help", Description: "Show available commands and additional information"},
-		{Text: "pwd", Description: "Show remote working directory"},
-		{Text: "lpwd", Description: "Show local working directory"},
-		{Text: "cd", Description: "Change remote directory"},
-		{Text: "lcd", Description: "Change local directory"},
-		{Text: "ls", Description: "List remote files in current directory"},
-		{Text: "lcd", Description: "List local files in current directory"},
-		{Text: "put", Description: "Upload specified files or directories"},
-		{Text: "get", Description: "Download specified files or directories"},
-		{Text: "exit", Description: "Exit program"},
-		{Text: "quit", Description: "Exit program"},
+	word := d.GetWordBeforeCursor()
+	args := strings.Fields(d.TextBeforeCursor())
+
+	if len(args) == 0 || (len(args) == 1 && word != "") {
+		return completeCommand(word)
+	}
+
+	c, _, err := cmd.Find(args[:1])
+	if err != nil || c == cmd {
+		return nil
 	}
 
-	return prompt.FilterHasPrefix(s, d.GetWordBeforeCursor(), true)
+	if strings.HasPrefix(word, "-") {
+		return completeFlag(c, word)
+	}
+
+	switch kind, ok := completions[c.Name()]; {
+	case !ok:
+		return nil
+	case kind == completeCommands:
+		return completeCommand(word)
+	default:
+		return completePath(word, kind)
+	}
 }
 
 func livePrefix() (string, bool) {
@@ -391,19 +1018,45 @@ func runCli() error {
 		},
 	})
 
-	cmd.AddCommand(&cobra.Command{
+	cmdGet := &cobra.Command{
 		Use:   "get FILE [FILE ...]",
 		Short: "Download specified remote files or directories into the current local directory",
-		Args:  cobra.MinimumNArgs(1),
+		Long: strings.TrimSpace(`
+Download specified remote files or directories into the current local
+directory. Directories are downloaded recursively, modification times are
+preserved.
+
+Existing local files are not replaced, unless either --overwrite, --skip or
+--newer is given.
+`),
+		Args: cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
+			o := getOptions
+
+			if (o.Overwrite && o.Skip) || (o.Overwrite && o.Newer) || (o.Skip && o.Newer) {
+				fmt.Fprintf(os.Stderr, "only one of --overwrite, --skip and --newer can be given\n")
+				return
+			}
+
+			stats := &transferStats{start: time.Now()}
+
 			for _, p := range args {
-				if err := download(p); err != nil {
-					fmt.Fprintf(os.Stderr, "download(%s): %v", p, err)
-					break
+				if err := download(p, stats); err != nil {
+					fmt.Fprintf(os.Stderr, "download(%s): %v\n", p, err)
+					stats.failed++
 				}
 			}
+
+			fmt.Fprintln(os.Stderr, stats)
 		},
-	})
+	}
+
+	f := cmdGet.Flags()
+	f.BoolVarP(&getOptions.Overwrite, "overwrite", "f", false, "overwrite existing local files")
+	f.BoolVarP(&getOptions.Skip, "skip", "s", false, "skip existing local files")
+	f.BoolVarP(&getOptions.Newer, "newer", "n", false, "overwrite existing local files only if the remote file is newer")
+
+	cmd.AddCommand(cmdGet)
 
 	cmd.AddCommand(&cobra.Command{
 		Use:   "cat FILE",
@@ -513,48 +1166,19 @@ func runCli() error {
 	cmd.AddCommand(&cobra.Command{
 		Use:   "edit FILE",
 		Short: "Edit a remote file using the editor specified in $EDITOR",
-		Args:  cobra.ExactArgs(1),
+		Long: strings.TrimSpace(`
+Edit a remote file using the editor specified in $EDITOR. The file is
+downloaded to a temporary file and uploaded again if it has been changed.
+
+If the remote file has been modified in the meantime, you are asked whether
+to overwrite it. If the file is not uploaded, a backup copy is kept in the
+current local directory.
+`),
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			p := path.Join(rpwd, args[0])
-
-			file, err := ioutil.TempFile("/tmp", "scmc")
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ioutil.TempFile: %v", err)
-				return
+			if err := edit(path.Join(rpwd, args[0])); err != nil {
+				fmt.Fprintf(os.Stderr, "edit(%s): %v\n", args[0], err)
 			}
-
-			defer func() {
-				if err := os.Remove(file.Name()); err != nil {
-					fmt.Fprintf(os.Stderr, "os.Remove: %v", err)
-				}
-			}()
-
-			hasher := sha256.New()
-			mw := io.MultiWriter(hasher, file)
-
-			if err := mc.GetFile(p, mw, ""); err != nil {
-				fmt.Fprintf(os.Stderr, "mc.GetFile(%s): %v\n", p, err)
-				return
-			}
-
-			//original_hash := hasher.Sum(nil)
-
-			editor, ok := os.LookupEnv("EDITOR")
-			if !ok {
-				editor = "vi"
-			}
-
-			c := exec.Command(editor, file.Name())
-			c.Stdout = os.Stdout
-			c.Stdin = os.Stdin
-			c.Stderr = os.Stderr
-
-			if err := c.Run(); err != nil {
-				fmt.Fprintf(os.Stderr, "c.Run: %v\n", err)
-				return
-			}
-
-			// TODO
 		},
 	})
 
@@ -580,6 +1204,9 @@ func runCli() error {
 		},
 	})
 
+	// Add the help command right away, so that it is completed as well.
+	cmd.InitDefaultHelpCmd()
+
 	pwd, err := os.Getwd()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/virvum/scmc/internal/annex"
+
+	"github.com/spf13/cobra"
+)
+
+// GitAnnexRemoteOptions represents options for the command "git-annex-remote".
+type GitAnnexRemoteOptions struct {
+	Username string
+	Password string
+}
+
+var gitAnnexRemoteOptions GitAnnexRemoteOptions
+
+var cmdGitAnnexRemote = &cobra.Command{
+	Use:   "git-annex-remote",
+	Short: "Act as git-annex special remote",
+	Long: strings.TrimSpace(`
+The "git-annex-remote" command implements the external special remote
+protocol of git-annex over standard input and output, so that myCloud can be
+used as special remote. git-annex runs "git-annex-remote-<externaltype>",
+hence scmc has to be linked under that name, in which case it runs this
+command:
+
+	ln -s "$(command -v scmc)" ~/bin/git-annex-remote-scmc
+	git annex initremote mycloud type=external externaltype=scmc \
+		encryption=shared directory=/Annex/datasets
+
+Keys are stored below "directory" (default "/git-annex") in two levels of
+directories named after the MD5 sum of the key, like the "hashdirlower"
+layout of git-annex. The size of stored files is checked, incomplete uploads
+are removed.
+
+The myCloud credentials are taken from the configuration file, the flags or
+the environment (they cannot be prompted for, since standard input carries
+the protocol).
+`),
+	DisableAutoGenTag: true,
+	Args:              cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		o := &gitAnnexRemoteOptions
+
+		if o.Username, o.Password = configCredentials(cmd, o.Username, o.Password); o.Username == "" || o.Password == "" {
+			return fmt.Errorf("myCloud username and password must be set in the configuration file, the flags or the environment")
+		}
+
+		return annex.New(log, o.Username, o.Password, os.Stdin, os.Stdout).Serve()
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdGitAnnexRemote)
+
+	f := cmdGitAnnexRemote.Flags()
+	f.StringVarP(&gitAnnexRemoteOptions.Username, "username", "u", os.Getenv("MYCLOUD_USERNAME"), "Swisscom myCloud username (default: $MYCLOUD_USERNAME)")
+	f.StringVarP(&gitAnnexRemoteOptions.Password, "password", "p", os.Getenv("MYCLOUD_PASSWORD"), "Swisscom myCloud password (default: $MYCLOUD_PASSWORD)")
+}
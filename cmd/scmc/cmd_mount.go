@@ -2,24 +2,57 @@ package main
 
 import (
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 // MountOptions represents options for the command "mount".
 type MountOptions struct {
-	Username string
-	Password string
+	Username   string
+	Password   string
+	AttrTTL    time.Duration
+	ReadAhead  int64
+	AllowOther bool
+	ReadOnly   bool
+	SpoolDir   string
 }
 
 var mountOptions MountOptions
 
 var cmdMount = &cobra.Command{
-	Use:               "mount [flags] mountpoint",
-	Short:             "mount myCloud drive locally (NOT YET IMPLEMENTED).",
+	Use:   "mount [flags] mountpoint",
+	Short: "Mount myCloud drive locally (Linux only)",
+	Long: strings.TrimSpace(`
+The "mount" command mounts the myCloud Drive at the given directory using FUSE
+and serves requests until it is unmounted, e.g. with "fusermount -u
+mountpoint", or until it receives SIGINT or SIGTERM, in which case it
+unmounts the directory itself.
+
+Files are read with ranged requests of at least "--read-ahead" MiB.
+Attributes and directory listings are cached for "--attr-ttl", so changes
+made elsewhere become visible after that duration.
+
+Files opened for writing are kept in a spool file in "--spool-dir" (which
+must be large enough to hold them) and uploaded when they are closed or
+synced, hence upload errors are reported by close(2) and fsync(2). Since
+myCloud stores whole files only, modifying a file downloads it first. Since
+myCloud cannot move directories, renaming one moves each file below it, and
+fails (EBUSY) while any of them is opened for writing. Directories can only
+be removed if they are empty. Use "--read-only" to reject all modifications.
+`),
 	DisableAutoGenTag: true,
 	Args:              cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		o := &mountOptions
+
+		if o.Username, o.Password, err = credentials(cmd, o.Username, o.Password); err != nil {
+			return err
+		}
+
 		return runMount(args[0])
 	},
 }
@@ -30,11 +63,9 @@ func init() {
 	f := cmdMount.Flags()
 	f.StringVarP(&mountOptions.Username, "username", "u", os.Getenv("MYCLOUD_USERNAME"), "Swisscom myCloud username")
 	f.StringVarP(&mountOptions.Password, "password", "p", os.Getenv("MYCLOUD_PASSWORD"), "Swisscom myCloud password")
-}
-
-func runMount(mountpoint string) error {
-	// TODO
-	// TODO umount: systemFuse.Unmount(mountpoint)
-
-	return nil
+	f.DurationVar(&mountOptions.AttrTTL, "attr-ttl", time.Minute, "duration for which attributes and directory listings are cached")
+	f.Int64Var(&mountOptions.ReadAhead, "read-ahead", 4, "minimum size of reads from myCloud, in MiB")
+	f.BoolVar(&mountOptions.AllowOther, "allow-other", false, `allow other users to access the file system (requires "user_allow_other" in /etc/fuse.conf)`)
+	f.BoolVar(&mountOptions.ReadOnly, "read-only", false, "mount the file system read-only")
+	f.StringVar(&mountOptions.SpoolDir, "spool-dir", os.TempDir(), "directory in which files opened for writing are kept until they are uploaded")
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/virvum/scmc/internal/resticapi"
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"github.com/spf13/cobra"
+)
+
+// ResticMigrateLayoutOptions represents options for the command "restic-migrate-layout".
+type ResticMigrateLayoutOptions struct {
+	Username    string
+	Password    string
+	BaseDir     string
+	Layout      string
+	Concurrency int
+}
+
+var resticMigrateLayoutOptions ResticMigrateLayoutOptions
+
+var cmdResticMigrateLayout = &cobra.Command{
+	Use:   "restic-migrate-layout [flags] repository",
+	Short: "Convert a restic repository on myCloud to another directory layout",
+	Long: strings.TrimSpace(`
+The "restic-migrate-layout" command converts the directory layout of a restic
+repository stored on myCloud, moving all data files either into the 256
+subdirectories of data/ ("default" layout) or directly into data/ ("flat"
+layout). The repository path is given as used by restic, relative to the base
+directory:
+
+	scmc restic-migrate-layout --base-dir /Backups/restic --layout flat host1
+
+Make sure that no restic-rest-server accesses the repository while it is being
+migrated. An interrupted migration is resumed by running the command again.
+Restart restic-rest-server with the new layout afterwards (and remove its pack
+file index, if enabled).
+`),
+	DisableAutoGenTag: true,
+	Args:              cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		o := &resticMigrateLayoutOptions
+
+		if o.Username, o.Password, err = credentials(cmd, o.Username, o.Password); err != nil {
+			return err
+		}
+
+		return runResticMigrateLayout(args[0])
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdResticMigrateLayout)
+
+	f := cmdResticMigrateLayout.Flags()
+	f.StringVarP(&resticMigrateLayoutOptions.Username, "username", "u", os.Getenv("MYCLOUD_USERNAME"), "Swisscom myCloud username (default: $MYCLOUD_USERNAME)")
+	f.StringVarP(&resticMigrateLayoutOptions.Password, "password", "p", os.Getenv("MYCLOUD_PASSWORD"), "Swisscom myCloud password (default: $MYCLOUD_PASSWORD)")
+	f.StringVar(&resticMigrateLayoutOptions.BaseDir, "base-dir", "/", "myCloud directory in which repositories are stored")
+	f.StringVar(&resticMigrateLayoutOptions.Layout, "layout", string(resticapi.LayoutDefault), fmt.Sprintf("target repository layout (either %s)", oxfordJoin(resticapi.Layouts, `"%s"`, "or")))
+	f.IntVar(&resticMigrateLayoutOptions.Concurrency, "concurrency", 8, "maximum number of files moved concurrently")
+}
+
+func runResticMigrateLayout(repo string) error {
+	o := resticMigrateLayoutOptions
+
+	mc, err := mycloud.New(o.Username, o.Password, log)
+	if err != nil {
+		return fmt.Errorf("mycloud.New: %v", err)
+	}
+
+	p := path.Join("/", o.BaseDir, repo)
+
+	n, err := resticapi.MigrateLayout(mc, p, resticapi.Layout(o.Layout), o.Concurrency, log)
+	if err != nil {
+		return fmt.Errorf("resticapi.MigrateLayout(%s): %v", p, err)
+	}
+
+	fmt.Printf("Repository %s migrated to the %s layout (%d files moved).\n", p, o.Layout, n)
+
+	return nil
+}
@@ -2,24 +2,50 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/config"
+	"github.com/virvum/scmc/internal/health"
+	"github.com/virvum/scmc/internal/listener"
+	"github.com/virvum/scmc/internal/metrics"
 	"github.com/virvum/scmc/internal/resticapi"
+	"github.com/virvum/scmc/internal/tlsconfig"
+	"github.com/virvum/scmc/pkg/mycloud"
 
 	"github.com/spf13/cobra"
 )
 
 // ResticRestServerOptions represents options for the command "restic-rest-server".
 type ResticRestServerOptions struct {
-	Address         string
-	ReadTimeout     time.Duration
-	WriteTimeout    time.Duration
-	MaxHeaderBytes  int
-	ShutdownTimeout time.Duration
+	Address          string
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	MaxHeaderBytes   int
+	ShutdownTimeout  time.Duration
+	TLS              tlsconfig.Options
+	BaseDir          string
+	Layout           string
+	CacheDir         string
+	CacheSize        int64
+	WritebackDir     string
+	WritebackWorkers int
+	Concurrency      int
+	IndexDir         string
+	ReadOnly         bool
+	MetricsAddress   string
+	AccessLog        string
+	AccessLogFormat  string
+	Check            bool
+	ReadyProbe       bool
+	ReadyInterval    time.Duration
+	SocketMode       string
+	IdleTimeout      time.Duration
 }
 
 var resticRestServerOptions ResticRestServerOptions
@@ -40,6 +66,70 @@ In another shell launch restic (replace username@password with your Swisscom
 myCloud username and password) pointing to the restic REST API service:
 
 	restic -r rest:http://username@password:127.0.0.1:9000/backup init
+
+Repositories are stored relative to the myCloud directory given by
+"--base-dir" (the root of the Drive by default), e.g. with "--base-dir
+/Backups/restic", the repository above is stored in /Backups/restic/backup.
+By default, data files are stored in 256 subdirectories of data/; use
+"--layout flat" to store them directly in data/ (see restic-migrate-layout).
+
+Instead of a TCP socket, the server can listen on a Unix domain socket, e.g.
+"--address unix:/run/scmc/restic.sock", which restic can use with
+"-r rest:http+unix:///run/scmc/restic.sock:/backup/".
+With "--address systemd", the server uses the socket passed by systemd (socket
+activation). Combined with "--idle-timeout", the server shuts down once no
+request has been served for the given duration and no uploads are pending,
+and systemd starts it again on the next connection.
+
+Unless the server only listens on localhost, TLS should be enabled, since the
+myCloud credentials are sent with every request. Either specify a certificate
+and key:
+
+	scmc restic-rest-server --tls-cert server.crt --tls-key server.key
+
+Or let the server generate a self-signed certificate on first start (the
+certificate and key are written to the given paths if they do not exist yet):
+
+	scmc restic-rest-server --tls-self-signed --tls-cert server.crt --tls-key server.key
+
+In the latter case, pass the certificate to restic via "--cacert server.crt".
+Sending SIGHUP to the server reloads the certificate and key.
+
+With "--read-only", only read operations are permitted, all write operations
+(including the creation of repositories and locks) are rejected with "403
+Forbidden". Individual users can be restricted by setting "readonly: true" for
+their entry in the "accounts" list of the configuration file. In both cases
+restic must be run with "--no-lock".
+
+With "--access-log", each request is written to the given file ("-" for
+standard output) in the Common Log Format ("--access-log-format common"), the
+Combined Log Format ("combined") or as JSON lines ("json"). Only JSON entries
+include the repository, file type, received bytes, duration, range and error.
+The file is reopened on SIGHUP, e.g. after it has been rotated.
+
+The endpoints /healthz and /readyz can be queried without authentication.
+With "--ready-probe", /readyz requests the usage of each account of the
+"accounts" list of the configuration file which has a password (results are
+cached for "--ready-interval") and fails with "503 Service Unavailable" if any
+of them cannot be used; the reasons are only logged. With "--check", the
+server is not started; instead, each of these accounts logs in and the
+command fails if any of them cannot.
+
+With "--metrics-address", metrics in the Prometheus text format are served at
+/metrics on a separate listener (without authentication), e.g.:
+
+	scmc restic-rest-server --metrics-address 127.0.0.1:9100
+
+With "--writeback-dir", data, index, keys and snapshots files are written to a
+local staging directory and acknowledged right away, while a pool of workers
+uploads them to myCloud in the background. Pending files are served from the
+staging directory and their uploads are resumed after a restart, as soon as
+their owner authenticates again.
+
+With "--index-dir", the names of all pack files are kept in a local index, so
+that listing data/ does not query myCloud at all. The index of a repository is
+built on its first listing and only stays accurate as long as the repository
+is solely modified through this server.
 `),
 	DisableAutoGenTag: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -51,40 +141,218 @@ func init() {
 	cmdRoot.AddCommand(cmdResticRestServer)
 
 	f := cmdResticRestServer.Flags()
-	f.StringVarP(&resticRestServerOptions.Address, "address", "a", "127.0.0.1:9000", "host:port to listen on")
+	f.StringVarP(&resticRestServerOptions.Address, "address", "a", "127.0.0.1:9000", `host:port to listen on, "unix:<path>" for a Unix domain socket or "systemd" for socket activation`)
+	f.StringVar(&resticRestServerOptions.SocketMode, "socket-mode", "0660", "permissions of the Unix domain socket (octal)")
+	f.DurationVar(&resticRestServerOptions.IdleTimeout, "idle-timeout", 0, "shut down after no request has been served for the given duration (disabled if 0)")
 	f.DurationVar(&resticRestServerOptions.ReadTimeout, "read-timeout", 300*time.Second, "read timeout")
 	f.DurationVar(&resticRestServerOptions.WriteTimeout, "write-timeout", 300*time.Second, "write timeout")
 	f.IntVar(&resticRestServerOptions.MaxHeaderBytes, "max-header-bytes", 10<<20, "maximum size of header, in bytes")
 	f.DurationVar(&resticRestServerOptions.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "the duration for which the server will gracefully wait for existing connections to finish")
+	f.StringVar(&resticRestServerOptions.BaseDir, "base-dir", "/", "myCloud directory in which repositories are stored")
+	f.StringVar(&resticRestServerOptions.Layout, "layout", string(resticapi.LayoutDefault), fmt.Sprintf("repository layout (either %s, see restic-migrate-layout)", oxfordJoin(resticapi.Layouts, `"%s"`, "or")))
+	f.BoolVar(&resticRestServerOptions.ReadOnly, "read-only", false, "reject all write operations (restic must be run with --no-lock)")
+	f.StringVar(&resticRestServerOptions.TLS.CertFile, "tls-cert", "", "TLS certificate file (reloaded on SIGHUP)")
+	f.StringVar(&resticRestServerOptions.TLS.KeyFile, "tls-key", "", "TLS private key file (reloaded on SIGHUP)")
+	f.StringVar(&resticRestServerOptions.TLS.ClientCA, "tls-client-ca", "", "CA bundle used to verify client certificates (enables client certificate authentication)")
+	f.StringVar(&resticRestServerOptions.CacheDir, "cache-dir", "", "directory of the local pack file cache (cache is disabled if not set)")
+	f.Int64Var(&resticRestServerOptions.CacheSize, "cache-size", 1024, "maximum size of the local pack file cache, in MiB")
+	f.StringVar(&resticRestServerOptions.WritebackDir, "writeback-dir", "", "staging directory for asynchronous uploads (uploads are synchronous if not set)")
+	f.IntVar(&resticRestServerOptions.WritebackWorkers, "writeback-workers", 4, "number of concurrent asynchronous uploads")
+	f.IntVar(&resticRestServerOptions.Concurrency, "concurrency", 16, "maximum number of concurrent myCloud requests when listing data/ or creating a repository")
+	f.StringVar(&resticRestServerOptions.IndexDir, "index-dir", "", "directory of the persistent pack file index (index is disabled if not set)")
+	f.StringVar(&resticRestServerOptions.MetricsAddress, "metrics-address", "", "host:port to serve Prometheus metrics at /metrics on (metrics are disabled if not set)")
+	f.StringVar(&resticRestServerOptions.AccessLog, "access-log", "", `file to write the access log to, "-" for standard output (requests are logged as informational messages if not set)`)
+	f.StringVar(&resticRestServerOptions.AccessLogFormat, "access-log-format", string(accesslog.FormatCommon), fmt.Sprintf("access log format (either %s)", oxfordJoin(accesslog.Formats, `"%s"`, "or")))
+	f.BoolVar(&resticRestServerOptions.Check, "check", false, "check whether all configured accounts can log in and exit")
+	f.BoolVar(&resticRestServerOptions.ReadyProbe, "ready-probe", false, "probe myCloud with all configured accounts on /readyz")
+	f.DurationVar(&resticRestServerOptions.ReadyInterval, "ready-interval", 60*time.Second, "duration for which the results of --ready-probe are cached")
+	f.BoolVar(&resticRestServerOptions.TLS.SelfSigned, "tls-self-signed", false, "generate a self-signed certificate at --tls-cert/--tls-key if it does not exist yet")
 }
 
 func runResticRestServer() error {
+	var (
+		readOnlyUsers []string
+		probed        []config.Account
+	)
+
+	for _, a := range cfg.Accounts {
+		if a.Password != "" {
+			probed = append(probed, a)
+		}
+	}
+
+	if resticRestServerOptions.Check {
+		return checkAccounts(probed)
+	}
+
+	for _, a := range cfg.Accounts {
+		if a.ReadOnly {
+			readOnlyUsers = append(readOnlyUsers, a.Username)
+		}
+	}
+
+	var (
+		reg       *metrics.Registry
+		mcOptions []mycloud.Option
+	)
+
+	if resticRestServerOptions.MetricsAddress != "" {
+		reg = metrics.New()
+		mcOptions = append(mcOptions, mycloud.WithRequestHook(myCloudMetrics(reg)))
+	}
+
+	al, err := openAccessLog(resticRestServerOptions.AccessLog, resticRestServerOptions.AccessLogFormat)
+	if err != nil {
+		return err
+	}
+
+	if al != nil {
+		defer al.Close()
+	}
+
+	api, err := resticapi.New(log, resticapi.Options{
+		BaseDir:          resticRestServerOptions.BaseDir,
+		Layout:           resticapi.Layout(resticRestServerOptions.Layout),
+		CacheDir:         resticRestServerOptions.CacheDir,
+		CacheSize:        resticRestServerOptions.CacheSize << 20,
+		WritebackDir:     resticRestServerOptions.WritebackDir,
+		WritebackWorkers: resticRestServerOptions.WritebackWorkers,
+		Concurrency:      resticRestServerOptions.Concurrency,
+		IndexDir:         resticRestServerOptions.IndexDir,
+		ReadOnly:         resticRestServerOptions.ReadOnly,
+		ReadOnlyUsers:    readOnlyUsers,
+		Metrics:          reg,
+		AccessLog:        al,
+		MyCloudOptions:   mcOptions,
+	})
+	if err != nil {
+		return fmt.Errorf("resticapi.New: %v", err)
+	}
+
+	var checker *health.Checker
+
+	if resticRestServerOptions.ReadyProbe {
+		if len(probed) == 0 {
+			return fmt.Errorf("--ready-probe requires accounts with passwords in the configuration file")
+		}
+
+		checker = health.New(probed, resticRestServerOptions.ReadyInterval, log, mcOptions...)
+	}
+
 	s := &http.Server{
 		Addr:           resticRestServerOptions.Address,
-		Handler:        resticapi.New(log),
+		Handler:        health.Handler(api, checker),
 		ReadTimeout:    resticRestServerOptions.ReadTimeout,
 		WriteTimeout:   resticRestServerOptions.WriteTimeout,
 		MaxHeaderBytes: resticRestServerOptions.MaxHeaderBytes,
 	}
 
-	go func() {
-		log.Info("starting listener at %s", resticRestServerOptions.Address)
+	tc, err := setupTLS(s, resticRestServerOptions.TLS)
+	if err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(resticRestServerOptions.SocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode %q: %v", resticRestServerOptions.SocketMode, err)
+	}
+
+	l, err := listener.Listen(resticRestServerOptions.Address, os.FileMode(mode))
+	if err != nil {
+		return fmt.Errorf("listener.Listen: %v", err)
+	}
+
+	idle := make(<-chan struct{})
+
+	if resticRestServerOptions.IdleTimeout > 0 {
+		t := listener.NewIdleTracker(resticRestServerOptions.IdleTimeout, func() bool {
+			return api.PendingUploads() > 0
+		})
+
+		s.ConnState = t.ConnState
+		idle = t.Done()
+	}
 
-		if err := s.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatal("s.ListenAndServe: %v", err)
+	var ms *http.Server
+
+	if reg != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", reg)
+
+		ms = &http.Server{
+			Addr:    resticRestServerOptions.MetricsAddress,
+			Handler: mux,
 		}
-	}()
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
+		go func() {
+			log.Info("starting metrics listener at %s", resticRestServerOptions.MetricsAddress)
+
+			if err := ms.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal("ms.ListenAndServe: %v", err)
+			}
+		}()
+	}
+
+	serve(s, l, tc, al, idle)
 
 	ctx, cancel := context.WithTimeout(context.Background(), resticRestServerOptions.ShutdownTimeout)
 	defer cancel()
 
-	log.Info("caught signal, shutting down")
 	s.Shutdown(ctx)
+	api.Close()
+
+	if ms != nil {
+		ms.Shutdown(ctx)
+	}
+
 	log.Info("graceful shutdown completed")
 
+	if st, ok := api.CacheStats(); ok {
+		log.Info("cache: %d hits, %d misses (hit rate %.1f%%), %d files, %s of %s used",
+			st.Hits, st.Misses, 100*st.HitRate(), st.Entries, bytesToSize(uint64(st.Size)), bytesToSize(uint64(st.MaxSize)))
+	}
+
+	return nil
+}
+
+// myCloudMetrics registers metrics of requests to myCloud and returns the
+// hook which records them.
+func myCloudMetrics(reg *metrics.Registry) mycloud.RequestHook {
+	var (
+		duration = reg.Histogram("scmc_mycloud_request_duration_seconds", "Duration of requests to myCloud.", metrics.DefaultBuckets, "method", "action")
+		errors   = reg.Counter("scmc_mycloud_request_errors_total", "Number of failed requests to myCloud.", "method", "action")
+	)
+
+	return func(method string, action string, status int, d time.Duration, err error) {
+		duration.Observe(d.Seconds(), method, action)
+
+		if err != nil || status >= 500 {
+			errors.Inc(method, action)
+		}
+	}
+}
+
+// checkAccounts logs in with all given accounts and fails if any of them
+// cannot log in.
+func checkAccounts(accounts []config.Account) error {
+	if len(accounts) == 0 {
+		return fmt.Errorf("no accounts with passwords configured")
+	}
+
+	var failed int
+
+	for _, r := range health.New(accounts, 0, log).Login() {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("%s: %v\n", r.Username, r.Err)
+		} else {
+			fmt.Printf("%s: ok\n", r.Username)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d accounts failed", failed, len(accounts))
+	}
+
 	return nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/virvum/scmc/internal/listener"
+	"github.com/virvum/scmc/internal/resticapi"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/http2"
+)
+
+// ResticServeStdioOptions represents options for the command "restic-serve-stdio".
+type ResticServeStdioOptions struct {
+	Username    string
+	Password    string
+	BaseDir     string
+	Layout      string
+	CacheDir    string
+	CacheSize   int64
+	IndexDir    string
+	Concurrency int
+	ReadOnly    bool
+}
+
+var resticServeStdioOptions ResticServeStdioOptions
+
+var cmdResticServeStdio = &cobra.Command{
+	Use:   "restic-serve-stdio [flags] repository",
+	Short: "Serve the restic REST API over standard input and output",
+	Long: strings.TrimSpace(`
+The "restic-serve-stdio" command serves the restic REST API over a single
+connection on standard input and output, like "rclone serve restic --stdio".
+This allows restic to start scmc itself via its rclone backend, so that
+neither a listening server nor a password in the repository URL is needed.
+The myCloud credentials are taken from the configuration file, the flags or
+the environment (they cannot be prompted for).
+
+restic appends the repository path to the command, so a repository stored in
+/Backups/restic/host1 is used as follows:
+
+	restic -o rclone.program=scmc -o rclone.args=restic-serve-stdio \
+		-r rclone:host1 snapshots
+
+with "--base-dir /Backups/restic" added to rclone.args, or simply with
+"-r rclone:/Backups/restic/host1". Both HTTP/2 (as used by restic) and
+HTTP/1.1 are accepted.
+`),
+	DisableAutoGenTag: true,
+	Args:              cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		o := &resticServeStdioOptions
+
+		// Standard input carries the protocol, hence prompting is impossible.
+		if o.Username, o.Password = configCredentials(cmd, o.Username, o.Password); o.Username == "" || o.Password == "" {
+			return fmt.Errorf("myCloud username and password must be set in the configuration file, the flags or the environment")
+		}
+
+		return runResticServeStdio(args[0])
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdResticServeStdio)
+
+	f := cmdResticServeStdio.Flags()
+	f.StringVarP(&resticServeStdioOptions.Username, "username", "u", os.Getenv("MYCLOUD_USERNAME"), "Swisscom myCloud username (default: $MYCLOUD_USERNAME)")
+	f.StringVarP(&resticServeStdioOptions.Password, "password", "p", os.Getenv("MYCLOUD_PASSWORD"), "Swisscom myCloud password (default: $MYCLOUD_PASSWORD)")
+	f.StringVar(&resticServeStdioOptions.BaseDir, "base-dir", "/", "myCloud directory in which repositories are stored")
+	f.StringVar(&resticServeStdioOptions.Layout, "layout", string(resticapi.LayoutDefault), fmt.Sprintf("repository layout (either %s, see restic-migrate-layout)", oxfordJoin(resticapi.Layouts, `"%s"`, "or")))
+	f.StringVar(&resticServeStdioOptions.CacheDir, "cache-dir", "", "directory of the local pack file cache (cache is disabled if not set)")
+	f.Int64Var(&resticServeStdioOptions.CacheSize, "cache-size", 1024, "maximum size of the local pack file cache, in MiB")
+	f.StringVar(&resticServeStdioOptions.IndexDir, "index-dir", "", "directory of the persistent pack file index (index is disabled if not set)")
+	f.IntVar(&resticServeStdioOptions.Concurrency, "concurrency", 16, "maximum number of concurrent myCloud requests when listing data/ or creating a repository")
+	f.BoolVar(&resticServeStdioOptions.ReadOnly, "read-only", false, "reject all write operations (restic must be run with --no-lock)")
+}
+
+func runResticServeStdio(repo string) error {
+	o := resticServeStdioOptions
+
+	api, err := resticapi.New(log, resticapi.Options{
+		BaseDir:     o.BaseDir,
+		Layout:      resticapi.Layout(o.Layout),
+		CacheDir:    o.CacheDir,
+		CacheSize:   o.CacheSize << 20,
+		IndexDir:    o.IndexDir,
+		Concurrency: o.Concurrency,
+		ReadOnly:    o.ReadOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("resticapi.New: %v", err)
+	}
+
+	defer api.Close()
+
+	// restic addresses the repository as the root of the server, while the
+	// API expects the repository path as prefix of each request.
+	prefix := strings.TrimRight(path.Join("/", repo), "/")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = prefix + r.URL.Path
+		r.SetBasicAuth(o.Username, o.Password)
+		api.ServeHTTP(w, r)
+	})
+
+	var (
+		in   = bufio.NewReader(os.Stdin)
+		conn = listener.NewStdioConn(in, os.Stdout)
+	)
+
+	// HTTP/2 clients without TLS start with the connection preface.
+	if preface, err := in.Peek(len(http2.ClientPreface)); err == nil && string(preface) == http2.ClientPreface {
+		log.Debug("serving HTTP/2 over stdio")
+
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		conn.Close()
+
+		return nil
+	}
+
+	log.Debug("serving HTTP/1.1 over stdio")
+
+	if err := (&http.Server{Handler: handler}).Serve(listener.Single(conn)); err != nil && err != io.EOF {
+		return fmt.Errorf("s.Serve: %v", err)
+	}
+
+	return nil
+}
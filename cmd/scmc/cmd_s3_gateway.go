@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/listener"
+	"github.com/virvum/scmc/internal/s3api"
+	"github.com/virvum/scmc/internal/tlsconfig"
+
+	"github.com/spf13/cobra"
+)
+
+// S3GatewayOptions represents options for the command "s3-gateway".
+type S3GatewayOptions struct {
+	Address         string
+	SocketMode      string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	MaxHeaderBytes  int
+	ShutdownTimeout time.Duration
+	TLS             tlsconfig.Options
+	Region          string
+	MultipartDir    string
+	ReadOnly        bool
+	AccessLog       string
+	AccessLogFormat string
+}
+
+var s3GatewayOptions S3GatewayOptions
+
+var cmdS3Gateway = &cobra.Command{
+	Use:   "s3-gateway",
+	Short: "Launch an S3-compatible gateway",
+	Long: strings.TrimSpace(`
+The "s3-gateway" command launches a server which implements a subset of the
+Amazon S3 API, so that S3 clients (aws-cli, rclone, s3cmd, ...) can access
+myCloud:
+
+	scmc s3-gateway --address 127.0.0.1:9090
+
+Requests are authenticated with AWS Signature Version 4 (both the
+Authorization header and presigned URLs). The access keys are configured
+per account in the configuration file:
+
+	accounts:
+	  - username: user@example.com
+	    password: secret
+	    accesskeyid: AKIAEXAMPLE
+	    secretaccesskey: verysecret
+	    readonly: false
+
+Only path-style addressing is supported (e.g. "--endpoint-url" of aws-cli
+with "addressing_style = path"). Buckets are the top-level directories of the
+Drive, objects are the files below them; keys ending with a slash denote
+directories. Supported operations are ListBuckets, CreateBucket, DeleteBucket,
+HeadBucket, GetBucketLocation, ListObjects(V2), GetObject and HeadObject
+(including ranges), PutObject, CopyObject, DeleteObject and multipart uploads.
+Versioning, ACLs, tagging, lifecycle rules and similar are not supported.
+
+ETags of objects are the hashes reported by myCloud, which are not
+necessarily MD5 sums; PutObject, CopyObject and CompleteMultipartUpload
+return the same ETag as HeadObject and ListObjects. Parts of multipart uploads are stored in
+"--multipart-dir" until the upload is completed, at which point the whole
+object is uploaded to myCloud. The state of multipart uploads is only kept in
+memory: when the server is restarted, uploads in progress fail with
+NoSuchUpload and have to be started again, and their parts are left behind in
+"scmc-s3-*" directories of "--multipart-dir", which can be removed while the
+server is stopped. Objects are spooled there as well until their payload is
+verified, so that failed uploads do not replace existing objects.
+
+TLS and the access log are configured the same way as for restic-rest-server.
+With "--read-only", all write operations are rejected; individual accounts
+can be restricted with "readonly: true".
+`),
+	DisableAutoGenTag: true,
+	Args:              cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runS3Gateway()
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdS3Gateway)
+
+	f := cmdS3Gateway.Flags()
+	f.StringVarP(&s3GatewayOptions.Address, "address", "a", "127.0.0.1:9090", `host:port to listen on, "unix:<path>" for a Unix domain socket or "systemd" for socket activation`)
+	f.StringVar(&s3GatewayOptions.SocketMode, "socket-mode", "0660", "permissions of the Unix domain socket (octal)")
+	f.DurationVar(&s3GatewayOptions.ReadTimeout, "read-timeout", 0, "read timeout (disabled if 0, large uploads may take a while)")
+	f.DurationVar(&s3GatewayOptions.WriteTimeout, "write-timeout", 0, "write timeout (disabled if 0, large downloads may take a while)")
+	f.IntVar(&s3GatewayOptions.MaxHeaderBytes, "max-header-bytes", 10<<20, "maximum size of header, in bytes")
+	f.DurationVar(&s3GatewayOptions.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "the duration for which the server will gracefully wait for existing connections to finish")
+	f.StringVar(&s3GatewayOptions.TLS.CertFile, "tls-cert", "", "TLS certificate file (reloaded on SIGHUP)")
+	f.StringVar(&s3GatewayOptions.TLS.KeyFile, "tls-key", "", "TLS private key file (reloaded on SIGHUP)")
+	f.StringVar(&s3GatewayOptions.TLS.ClientCA, "tls-client-ca", "", "CA bundle used to verify client certificates (enables client certificate authentication)")
+	f.BoolVar(&s3GatewayOptions.TLS.SelfSigned, "tls-self-signed", false, "generate a self-signed certificate at --tls-cert/--tls-key if it does not exist yet")
+	f.StringVar(&s3GatewayOptions.Region, "region", "us-east-1", "region reported by GetBucketLocation")
+	f.StringVar(&s3GatewayOptions.MultipartDir, "multipart-dir", os.TempDir(), "directory in which parts of multipart uploads and objects are stored until they are verified and uploaded")
+	f.BoolVar(&s3GatewayOptions.ReadOnly, "read-only", false, "reject all write operations")
+	f.StringVar(&s3GatewayOptions.AccessLog, "access-log", "", `file to write the access log to, "-" for standard output (requests are logged as informational messages if not set)`)
+	f.StringVar(&s3GatewayOptions.AccessLogFormat, "access-log-format", string(accesslog.FormatCommon), fmt.Sprintf("access log format (either %s)", oxfordJoin(accesslog.Formats, `"%s"`, "or")))
+}
+
+func runS3Gateway() error {
+	o := s3GatewayOptions
+
+	var credentials []s3api.Credentials
+
+	for _, a := range cfg.Accounts {
+		if a.AccessKeyID == "" {
+			continue
+		}
+
+		credentials = append(credentials, s3api.Credentials{
+			AccessKeyID:     a.AccessKeyID,
+			SecretAccessKey: a.SecretAccessKey,
+			Username:        a.Username,
+			Password:        a.Password,
+			ReadOnly:        a.ReadOnly,
+		})
+	}
+
+	if len(credentials) == 0 {
+		return fmt.Errorf("no account with an access key ID found in the configuration file")
+	}
+
+	al, err := openAccessLog(o.AccessLog, o.AccessLogFormat)
+	if err != nil {
+		return err
+	}
+
+	if al != nil {
+		defer al.Close()
+	}
+
+	api, err := s3api.New(log, s3api.Options{
+		Credentials:  credentials,
+		Region:       o.Region,
+		MultipartDir: o.MultipartDir,
+		ReadOnly:     o.ReadOnly,
+		AccessLog:    al,
+	})
+	if err != nil {
+		return err
+	}
+
+	defer api.Close()
+
+	s := &http.Server{
+		Addr:           o.Address,
+		Handler:        api,
+		ReadTimeout:    o.ReadTimeout,
+		WriteTimeout:   o.WriteTimeout,
+		MaxHeaderBytes: o.MaxHeaderBytes,
+	}
+
+	tc, err := setupTLS(s, o.TLS)
+	if err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(o.SocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode %q: %v", o.SocketMode, err)
+	}
+
+	l, err := listener.Listen(o.Address, os.FileMode(mode))
+	if err != nil {
+		return fmt.Errorf("listener.Listen: %v", err)
+	}
+
+	serve(s, l, tc, al, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.ShutdownTimeout)
+	defer cancel()
+
+	s.Shutdown(ctx)
+
+	log.Info("graceful shutdown completed")
+
+	return nil
+}
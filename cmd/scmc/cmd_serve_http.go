@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/browse"
+	"github.com/virvum/scmc/internal/listener"
+	"github.com/virvum/scmc/internal/tlsconfig"
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"github.com/spf13/cobra"
+)
+
+// ServeHTTPOptions represents options for the command "serve-http".
+type ServeHTTPOptions struct {
+	Username        string
+	Password        string
+	Address         string
+	SocketMode      string
+	Root            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	MaxHeaderBytes  int
+	ShutdownTimeout time.Duration
+	TLS             tlsconfig.Options
+	ListTTL         time.Duration
+	AccessLog       string
+	AccessLogFormat string
+}
+
+var serveHTTPOptions ServeHTTPOptions
+
+var cmdServeHTTP = &cobra.Command{
+	Use:   "serve-http",
+	Short: "Serve a myCloud directory read-only over HTTP",
+	Long: strings.TrimSpace(`
+The "serve-http" command launches an HTTP server which serves a directory of
+the myCloud Drive read-only, e.g. to share it within the LAN, where it can be
+browsed with any web browser:
+
+	scmc serve-http --address 0.0.0.0:8000 --root /Shared
+
+Anyone who can reach the server can read all files below "--root" (the whole
+Drive by default), since clients do not authenticate; the myCloud credentials
+are taken from the configuration file, the flags or the environment, or are
+prompted for.
+
+Directory listings are rendered as HTML and can be sorted by name, size and
+modification time. Scripts can request listings as JSON with "?format=json"
+or an "Accept: application/json" header:
+
+	curl 'http://127.0.0.1:8000/Photos/?format=json&sort=mtime&order=desc'
+
+Files are streamed from myCloud, including range requests, and
+"If-Modified-Since" is answered with "304 Not Modified" if the file has not
+changed. Listings are cached for "--list-ttl". TLS and the access log are
+configured the same way as for restic-rest-server.
+`),
+	DisableAutoGenTag: true,
+	Args:              cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		o := &serveHTTPOptions
+
+		if o.Username, o.Password, err = credentials(cmd, o.Username, o.Password); err != nil {
+			return err
+		}
+
+		return runServeHTTP()
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdServeHTTP)
+
+	f := cmdServeHTTP.Flags()
+	f.StringVarP(&serveHTTPOptions.Username, "username", "u", os.Getenv("MYCLOUD_USERNAME"), "Swisscom myCloud username")
+	f.StringVarP(&serveHTTPOptions.Password, "password", "p", os.Getenv("MYCLOUD_PASSWORD"), "Swisscom myCloud password")
+	f.StringVarP(&serveHTTPOptions.Address, "address", "a", "127.0.0.1:8000", `host:port to listen on, "unix:<path>" for a Unix domain socket or "systemd" for socket activation`)
+	f.StringVar(&serveHTTPOptions.SocketMode, "socket-mode", "0660", "permissions of the Unix domain socket (octal)")
+	f.StringVar(&serveHTTPOptions.Root, "root", "/", "myCloud directory to serve")
+	f.DurationVar(&serveHTTPOptions.ReadTimeout, "read-timeout", 30*time.Second, "read timeout")
+	f.DurationVar(&serveHTTPOptions.WriteTimeout, "write-timeout", 0, "write timeout (disabled if 0, large downloads may take a while)")
+	f.IntVar(&serveHTTPOptions.MaxHeaderBytes, "max-header-bytes", 1<<20, "maximum size of header, in bytes")
+	f.DurationVar(&serveHTTPOptions.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "the duration for which the server will gracefully wait for existing connections to finish")
+	f.StringVar(&serveHTTPOptions.TLS.CertFile, "tls-cert", "", "TLS certificate file (reloaded on SIGHUP)")
+	f.StringVar(&serveHTTPOptions.TLS.KeyFile, "tls-key", "", "TLS private key file (reloaded on SIGHUP)")
+	f.StringVar(&serveHTTPOptions.TLS.ClientCA, "tls-client-ca", "", "CA bundle used to verify client certificates (enables client certificate authentication)")
+	f.BoolVar(&serveHTTPOptions.TLS.SelfSigned, "tls-self-signed", false, "generate a self-signed certificate at --tls-cert/--tls-key if it does not exist yet")
+	f.DurationVar(&serveHTTPOptions.ListTTL, "list-ttl", 10*time.Second, "duration for which directory listings are cached")
+	f.StringVar(&serveHTTPOptions.AccessLog, "access-log", "", `file to write the access log to, "-" for standard output (requests are logged as informational messages if not set)`)
+	f.StringVar(&serveHTTPOptions.AccessLogFormat, "access-log-format", string(accesslog.FormatCommon), fmt.Sprintf("access log format (either %s)", oxfordJoin(accesslog.Formats, `"%s"`, "or")))
+}
+
+func runServeHTTP() error {
+	o := serveHTTPOptions
+
+	mc, err := mycloud.New(o.Username, o.Password, log)
+	if err != nil {
+		return fmt.Errorf("mycloud.New: %v", err)
+	}
+
+	root := path.Clean("/" + o.Root)
+
+	if _, err := mc.Metadata(strings.TrimSuffix(root, "/") + "/"); err != nil {
+		return fmt.Errorf("unable to list %s: %v", root, err)
+	}
+
+	al, err := openAccessLog(o.AccessLog, o.AccessLogFormat)
+	if err != nil {
+		return err
+	}
+
+	if al != nil {
+		defer al.Close()
+	}
+
+	s := &http.Server{
+		Addr: o.Address,
+		Handler: browse.NewHandler(log, mc, browse.Options{
+			Root:      root,
+			ListTTL:   o.ListTTL,
+			AccessLog: al,
+		}),
+		ReadTimeout:    o.ReadTimeout,
+		WriteTimeout:   o.WriteTimeout,
+		MaxHeaderBytes: o.MaxHeaderBytes,
+	}
+
+	tc, err := setupTLS(s, o.TLS)
+	if err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(o.SocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode %q: %v", o.SocketMode, err)
+	}
+
+	l, err := listener.Listen(o.Address, os.FileMode(mode))
+	if err != nil {
+		return fmt.Errorf("listener.Listen: %v", err)
+	}
+
+	serve(s, l, tc, al, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.ShutdownTimeout)
+	defer cancel()
+
+	s.Shutdown(ctx)
+
+	log.Info("graceful shutdown completed")
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/virvum/scmc/internal/listener"
+	"github.com/virvum/scmc/internal/sftpfs"
+
+	"github.com/spf13/cobra"
+)
+
+// SFTPServerOptions represents options for the command "sftp-server".
+type SFTPServerOptions struct {
+	Address        string
+	SocketMode     string
+	HostKey        string
+	AuthorizedKeys string
+	ListTTL        time.Duration
+	ReadAhead      int64
+	SpoolDir       string
+	ReadOnly       bool
+}
+
+var sftpServerOptions SFTPServerOptions
+
+var cmdSFTPServer = &cobra.Command{
+	Use:   "sftp-server",
+	Short: "Launch an SFTP server",
+	Long: strings.TrimSpace(`
+The "sftp-server" command launches an SSH server which provides the SFTP
+subsystem, so that the myCloud Drive can be accessed with sftp, scp (using
+the SFTP protocol), rsync-less scripts and file managers:
+
+	scmc sftp-server --address 127.0.0.1:2022
+
+Clients authenticate with public keys, which are listed in the file given by
+"--authorized-keys" in the format of OpenSSH's authorized_keys. Each key is
+assigned to an account of the "accounts" list of the configuration file with
+the option account="<username>":
+
+	account="user@example.com" ssh-ed25519 AAAAC3Nza... reports@host1
+
+If a key is assigned to several accounts, the SSH username selects the
+account. Sending SIGHUP to the server reloads the authorized keys file. The
+host key is generated at "--host-key" if it does not exist yet.
+
+Reads are served using range requests. Since myCloud only stores whole files,
+files opened for writing are kept in "--spool-dir" and uploaded when they are
+closed; existing files are downloaded first unless they are truncated.
+Permissions and timestamps cannot be set, such requests are ignored. Renaming
+files and directories copies and removes them. Shells and commands are not
+supported.
+
+With "--read-only", all write operations are rejected. Individual accounts can
+be restricted by setting "readonly: true" in the configuration file.
+`),
+	DisableAutoGenTag: true,
+	Args:              cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSFTPServer()
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdSFTPServer)
+
+	home, _ := os.UserHomeDir()
+
+	f := cmdSFTPServer.Flags()
+	f.StringVarP(&sftpServerOptions.Address, "address", "a", "127.0.0.1:2022", `host:port to listen on, "unix:<path>" for a Unix domain socket or "systemd" for socket activation`)
+	f.StringVar(&sftpServerOptions.SocketMode, "socket-mode", "0660", "permissions of the Unix domain socket (octal)")
+	f.StringVar(&sftpServerOptions.HostKey, "host-key", filepath.Join(home, ".scmc_host_key"), "private host key file (generated if it does not exist)")
+	f.StringVar(&sftpServerOptions.AuthorizedKeys, "authorized-keys", filepath.Join(home, ".scmc_authorized_keys"), "authorized keys file (reloaded on SIGHUP)")
+	f.DurationVar(&sftpServerOptions.ListTTL, "list-ttl", 10*time.Second, "duration for which directory listings are cached")
+	f.Int64Var(&sftpServerOptions.ReadAhead, "read-ahead", 4, "minimum size of reads from myCloud, in MiB")
+	f.StringVar(&sftpServerOptions.SpoolDir, "spool-dir", os.TempDir(), "directory in which files opened for writing are kept until they are uploaded")
+	f.BoolVar(&sftpServerOptions.ReadOnly, "read-only", false, "reject all write operations")
+}
+
+func runSFTPServer() error {
+	o := sftpServerOptions
+
+	var accounts []sftpfs.Account
+
+	for _, a := range cfg.Accounts {
+		accounts = append(accounts, sftpfs.Account{
+			Username: a.Username,
+			Password: a.Password,
+			ReadOnly: a.ReadOnly,
+		})
+	}
+
+	if len(accounts) == 0 {
+		return fmt.Errorf("no accounts found in the configuration file")
+	}
+
+	s, err := sftpfs.NewServer(log, sftpfs.Options{
+		HostKeyFile:        o.HostKey,
+		AuthorizedKeysFile: o.AuthorizedKeys,
+		Accounts:           accounts,
+		FS: sftpfs.FSOptions{
+			ListTTL:   o.ListTTL,
+			ReadAhead: o.ReadAhead << 20,
+			SpoolDir:  o.SpoolDir,
+			ReadOnly:  o.ReadOnly,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(o.SocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode %q: %v", o.SocketMode, err)
+	}
+
+	l, err := listener.Listen(o.Address, os.FileMode(mode))
+	if err != nil {
+		return fmt.Errorf("listener.Listen: %v", err)
+	}
+
+	go func() {
+		log.Info("starting listener at %s", l.Addr())
+
+		if err := s.Serve(l); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			log.Fatal("s.Serve: %v", err)
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	defer signal.Stop(c)
+
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			log.Info("caught signal %s, shutting down", sig)
+			break
+		}
+
+		if err := s.Reload(); err != nil {
+			log.Error("caught SIGHUP, unable to reload authorized keys: %v", err)
+		}
+	}
+
+	l.Close()
+	s.Close()
+
+	log.Info("shutdown completed")
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/davfs"
+	"github.com/virvum/scmc/internal/listener"
+	"github.com/virvum/scmc/internal/tlsconfig"
+
+	"github.com/spf13/cobra"
+)
+
+// WebDAVOptions represents options for the command "webdav".
+type WebDAVOptions struct {
+	Address         string
+	SocketMode      string
+	Prefix          string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	MaxHeaderBytes  int
+	ShutdownTimeout time.Duration
+	TLS             tlsconfig.Options
+	ListTTL         time.Duration
+	ReadOnly        bool
+	AccessLog       string
+	AccessLogFormat string
+}
+
+var webDAVOptions WebDAVOptions
+
+var cmdWebDAV = &cobra.Command{
+	Use:   "webdav",
+	Short: "Launch a WebDAV server",
+	Long: strings.TrimSpace(`
+The "webdav" command launches a WebDAV server which serves the myCloud Drive
+of each user, e.g. to mount it with a file manager or davfs2:
+
+	scmc webdav --address 127.0.0.1:8080
+
+Clients authenticate with their Swisscom myCloud username and password (HTTP
+basic authentication), just like with restic-rest-server. Unless the server
+only listens on localhost, TLS should be enabled using the same options as
+restic-rest-server ("--tls-cert", "--tls-key", "--tls-self-signed" and
+"--tls-client-ca"). Sending SIGHUP to the server reloads the certificate and
+reopens the access log.
+
+Files are streamed from myCloud (including range requests) and uploaded while
+they are written, but since myCloud only stores whole files, partial updates
+are not supported. Moving files and directories copies and removes them, so
+moving large trees takes a while. Directory listings are cached for
+"--list-ttl", hence changes made elsewhere become visible after that duration.
+
+With "--read-only", all write operations are rejected with "403 Forbidden".
+Individual users can be restricted by setting "readonly: true" for their
+entry in the "accounts" list of the configuration file.
+`),
+	DisableAutoGenTag: true,
+	Args:              cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runWebDAV()
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdWebDAV)
+
+	f := cmdWebDAV.Flags()
+	f.StringVarP(&webDAVOptions.Address, "address", "a", "127.0.0.1:8080", `host:port to listen on, "unix:<path>" for a Unix domain socket or "systemd" for socket activation`)
+	f.StringVar(&webDAVOptions.SocketMode, "socket-mode", "0660", "permissions of the Unix domain socket (octal)")
+	f.StringVar(&webDAVOptions.Prefix, "prefix", "", `URL path prefix under which the Drive is served (e.g. "/dav")`)
+	f.DurationVar(&webDAVOptions.ReadTimeout, "read-timeout", 0, "read timeout (disabled if 0, large uploads may take a while)")
+	f.DurationVar(&webDAVOptions.WriteTimeout, "write-timeout", 0, "write timeout (disabled if 0, large downloads may take a while)")
+	f.IntVar(&webDAVOptions.MaxHeaderBytes, "max-header-bytes", 10<<20, "maximum size of header, in bytes")
+	f.DurationVar(&webDAVOptions.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "the duration for which the server will gracefully wait for existing connections to finish")
+	f.StringVar(&webDAVOptions.TLS.CertFile, "tls-cert", "", "TLS certificate file (reloaded on SIGHUP)")
+	f.StringVar(&webDAVOptions.TLS.KeyFile, "tls-key", "", "TLS private key file (reloaded on SIGHUP)")
+	f.StringVar(&webDAVOptions.TLS.ClientCA, "tls-client-ca", "", "CA bundle used to verify client certificates (enables client certificate authentication)")
+	f.BoolVar(&webDAVOptions.TLS.SelfSigned, "tls-self-signed", false, "generate a self-signed certificate at --tls-cert/--tls-key if it does not exist yet")
+	f.DurationVar(&webDAVOptions.ListTTL, "list-ttl", 10*time.Second, "duration for which directory listings are cached")
+	f.BoolVar(&webDAVOptions.ReadOnly, "read-only", false, "reject all write operations")
+	f.StringVar(&webDAVOptions.AccessLog, "access-log", "", `file to write the access log to, "-" for standard output (requests are logged as informational messages if not set)`)
+	f.StringVar(&webDAVOptions.AccessLogFormat, "access-log-format", string(accesslog.FormatCommon), fmt.Sprintf("access log format (either %s)", oxfordJoin(accesslog.Formats, `"%s"`, "or")))
+}
+
+func runWebDAV() error {
+	o := webDAVOptions
+
+	var readOnlyUsers []string
+
+	for _, a := range cfg.Accounts {
+		if a.ReadOnly {
+			readOnlyUsers = append(readOnlyUsers, a.Username)
+		}
+	}
+
+	al, err := openAccessLog(o.AccessLog, o.AccessLogFormat)
+	if err != nil {
+		return err
+	}
+
+	if al != nil {
+		defer al.Close()
+	}
+
+	s := &http.Server{
+		Addr: o.Address,
+		Handler: davfs.NewHandler(log, davfs.Options{
+			Prefix:        strings.TrimRight(o.Prefix, "/"),
+			ListTTL:       o.ListTTL,
+			ReadOnly:      o.ReadOnly,
+			ReadOnlyUsers: readOnlyUsers,
+			AccessLog:     al,
+		}),
+		ReadTimeout:    o.ReadTimeout,
+		WriteTimeout:   o.WriteTimeout,
+		MaxHeaderBytes: o.MaxHeaderBytes,
+	}
+
+	tc, err := setupTLS(s, o.TLS)
+	if err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(o.SocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode %q: %v", o.SocketMode, err)
+	}
+
+	l, err := listener.Listen(o.Address, os.FileMode(mode))
+	if err != nil {
+		return fmt.Errorf("listener.Listen: %v", err)
+	}
+
+	serve(s, l, tc, al, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.ShutdownTimeout)
+	defer cancel()
+
+	s.Shutdown(ctx)
+
+	log.Info("graceful shutdown completed")
+
+	return nil
+}
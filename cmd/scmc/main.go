@@ -115,6 +115,11 @@ func main() {
 
 	log = logger.New(cfg.LogLevel, true, rootPath)
 
+	// git-annex runs special remotes as "git-annex-remote-<externaltype>".
+	if filepath.Base(os.Args[0]) == "git-annex-remote-scmc" {
+		cmdRoot.SetArgs(append([]string{cmdGitAnnexRemote.Name()}, os.Args[1:]...))
+	}
+
 	if err := cmdRoot.Execute(); err != nil {
 		log.Fatal("cmdRoot.Execute: %v", err)
 	}
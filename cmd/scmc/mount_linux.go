@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/virvum/scmc/internal/fusefs"
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+func runMount(mountpoint string) error {
+	o := mountOptions
+
+	mc, err := mycloud.New(o.Username, o.Password, log)
+	if err != nil {
+		return fmt.Errorf("mycloud.New: %v", err)
+	}
+
+	options := []fuse.MountOption{
+		fuse.FSName("mycloud"),
+		fuse.Subtype("scmc"),
+		fuse.MaxReadahead(uint32(o.ReadAhead << 20)),
+	}
+
+	if o.ReadOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+
+	if o.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+
+	c, err := fuse.Mount(mountpoint, options...)
+	if err != nil {
+		return fmt.Errorf("fuse.Mount: %v", err)
+	}
+
+	defer c.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Info("caught signal %s, unmounting %s", sig, mountpoint)
+
+		if err := fuse.Unmount(mountpoint); err != nil {
+			log.Error("fuse.Unmount: %v (is the file system busy?)", err)
+		}
+	}()
+
+	log.Info("serving myCloud at %s", mountpoint)
+
+	if err := fs.Serve(c, fusefs.New(mc, fusefs.Options{
+		AttrTTL:   o.AttrTTL,
+		ReadAhead: o.ReadAhead << 20,
+		ReadOnly:  o.ReadOnly,
+		SpoolDir:  o.SpoolDir,
+	}, log)); err != nil {
+		return fmt.Errorf("fs.Serve: %v", err)
+	}
+
+	<-c.Ready
+
+	if err := c.MountError; err != nil {
+		return fmt.Errorf("mount failed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func runMount(mountpoint string) error {
+	return fmt.Errorf("mount is not supported on %s", runtime.GOOS)
+}
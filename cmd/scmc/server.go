@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/tlsconfig"
+)
+
+// openAccessLog opens the access log at path in the given format, or returns
+// nil if path is empty.
+func openAccessLog(path string, format string) (*accesslog.Logger, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	l, err := accesslog.Open(path, accesslog.Format(format))
+	if err != nil {
+		return nil, fmt.Errorf("accesslog.Open: %v", err)
+	}
+
+	return l, nil
+}
+
+// setupTLS configures TLS for s if enabled in o, in which case the returned
+// configuration is used to reload the certificate. The host of s.Addr is
+// added to the hosts of a self-signed certificate.
+func setupTLS(s *http.Server, o tlsconfig.Options) (*tlsconfig.Config, error) {
+	if !o.Enabled() {
+		return nil, nil
+	}
+
+	if host, _, err := net.SplitHostPort(s.Addr); err == nil {
+		o.Hosts = append(o.Hosts, host)
+	}
+
+	c, err := tlsconfig.New(o, log)
+	if err != nil {
+		return nil, fmt.Errorf("tlsconfig.New: %v", err)
+	}
+
+	if s.TLSConfig, err = c.TLSConfig(); err != nil {
+		return nil, fmt.Errorf("c.TLSConfig: %v", err)
+	}
+
+	return c, nil
+}
+
+// serve serves s on l (using TLS if tc is not nil) until SIGINT or SIGTERM
+// is received or idle is closed. On SIGHUP, the access log is reopened and
+// the certificate is reloaded. The caller is responsible for shutting down s.
+func serve(s *http.Server, l net.Listener, tc *tlsconfig.Config, al *accesslog.Logger, idle <-chan struct{}) {
+	go func() {
+		var err error
+
+		if tc != nil {
+			log.Info("starting TLS listener at %s", l.Addr())
+			err = s.ServeTLS(l, "", "")
+		} else {
+			log.Info("starting listener at %s", l.Addr())
+			err = s.Serve(l)
+		}
+
+		if err != http.ErrServerClosed {
+			log.Fatal("s.Serve: %v", err)
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-idle:
+			log.Info("idle timeout reached, shutting down")
+			return
+		case sig := <-c:
+			if sig != syscall.SIGHUP {
+				log.Info("caught signal %s, shutting down", sig)
+				return
+			}
+
+			if al != nil {
+				if err := al.Reopen(); err != nil {
+					log.Error("caught SIGHUP, unable to reopen access log: %v", err)
+				}
+			}
+
+			if tc == nil {
+				log.Info("caught SIGHUP, TLS not enabled, no certificate to reload")
+				continue
+			}
+
+			if err := tc.Reload(); err != nil {
+				log.Error("caught SIGHUP, unable to reload certificate: %v", err)
+			}
+		}
+	}
+}
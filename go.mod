@@ -3,14 +3,18 @@ module github.com/virvum/scmc
 go 1.13
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
 	github.com/c-bata/go-prompt v0.2.3
 	github.com/cheggaaa/pb/v3 v3.0.3
 	github.com/google/uuid v1.1.1
 	github.com/mattn/go-runewidth v0.0.7 // indirect
+	github.com/pkg/sftp v1.11.0
 	github.com/pkg/term v0.0.0-20190109203006-aa71e9d9e942 // indirect
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	golang.org/x/crypto v0.0.0-20191202143827-86a70503ff7e
 	golang.org/x/lint v0.0.0-20191125180803-fdd1cda4f05f // indirect
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
 	golang.org/x/tools v0.0.0-20191206204035-259af5ff87bd // indirect
 	gopkg.in/yaml.v2 v2.2.7
 )
@@ -0,0 +1,188 @@
+// Package accesslog implements HTTP access logs in the Common Log Format, the
+// Combined Log Format or as JSON lines.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Format represents the format of access log entries.
+type Format string
+
+// Access log formats.
+const (
+	FormatCommon   Format = "common"
+	FormatCombined Format = "combined"
+	FormatJSON     Format = "json"
+)
+
+// Formats contains available formats as strings.
+var Formats = []string{string(FormatCommon), string(FormatCombined), string(FormatJSON)}
+
+// Entry represents a single request. The Common and Combined Log Formats only
+// contain the standard fields, JSON entries contain all fields.
+type Entry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Username   string    `json:"username,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	Duration   float64   `json:"duration"` // in seconds
+	Range      string    `json:"range,omitempty"`
+	Repo       string    `json:"repo,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Logger writes access log entries to a file or to standard output.
+type Logger struct {
+	mu     sync.Mutex
+	path   string
+	format Format
+	color  bool
+	w      io.Writer
+	f      *os.File
+}
+
+// Open creates an access logger which appends entries in the given format to
+// the file at path, or writes them to standard output if path is "-".
+// Entries written to a terminal are colored.
+func Open(path string, format Format) (*Logger, error) {
+	switch format {
+	case FormatCommon, FormatCombined, FormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid access log format %q", format)
+	}
+
+	l := &Logger{
+		path:   path,
+		format: format,
+	}
+
+	if path == "-" {
+		l.w = os.Stdout
+		l.color = format != FormatJSON && terminal.IsTerminal(int(os.Stdout.Fd()))
+
+		return l, nil
+	}
+
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reopen closes and reopens the log file, e.g. after it has been rotated.
+func (l *Logger) Reopen() error {
+	if l.path == "-" {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile(%s): %v", l.path, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		l.f.Close()
+	}
+
+	l.f, l.w = f, f
+
+	return nil
+}
+
+// Close closes the log file.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f, l.w = nil, ioutil.Discard
+
+	return err
+}
+
+// Log writes a single entry.
+func (l *Logger) Log(e Entry) {
+	var line []byte
+
+	switch l.format {
+	case FormatJSON:
+		b, err := json.Marshal(e)
+		if err != nil {
+			// All fields are strings and numbers, hence this cannot fail.
+			panic(err)
+		}
+
+		line = append(b, '\n')
+	default:
+		line = []byte(l.common(e) + "\n")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w.Write(line)
+}
+
+// common formats an entry in the Common or Combined Log Format.
+func (l *Logger) common(e Entry) string {
+	var (
+		request = strconv.Quote(fmt.Sprintf("%s %s %s", e.Method, e.URI, e.Proto))
+		status  = strconv.Itoa(e.Status)
+	)
+
+	if l.color {
+		switch {
+		case e.Status >= 500:
+			status = "\033[1;31m" + status + "\033[0m"
+		case e.Status >= 400:
+			status = "\033[1;33m" + status + "\033[0m"
+		default:
+			status = "\033[1;32m" + status + "\033[0m"
+		}
+
+		request = "\033[1;34m" + request + "\033[0m"
+	}
+
+	s := fmt.Sprintf("%s - %s [%s] %s %s %d",
+		dash(e.RemoteAddr), dash(e.Username), e.Time.Format("02/Jan/2006:15:04:05 -0700"), request, status, e.BytesOut)
+
+	if l.format == FormatCombined {
+		s += fmt.Sprintf(" %s %s", strconv.Quote(dash(e.Referer)), strconv.Quote(dash(e.UserAgent)))
+	}
+
+	return s
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
@@ -0,0 +1,120 @@
+package accesslog
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Recorder records the status code and the number of bytes written of a
+// response.
+type Recorder struct {
+	http.ResponseWriter
+	status int
+	size   uint64
+}
+
+// NewRecorder wraps w.
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w}
+}
+
+// WriteHeader records the status code and writes the header.
+func (rec *Recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts and writes p.
+func (rec *Recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	n, err := rec.ResponseWriter.Write(p)
+	rec.size += uint64(n)
+
+	return n, err
+}
+
+// Flush flushes the underlying response writer, if supported.
+func (rec *Recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the status code of the response.
+func (rec *Recorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+
+	return rec.status
+}
+
+// Written returns true if the header has been written.
+func (rec *Recorder) Written() bool {
+	return rec.status != 0
+}
+
+// Size returns the number of bytes written.
+func (rec *Recorder) Size() uint64 {
+	return rec.size
+}
+
+// Counter counts the bytes read from a request body.
+type Counter struct {
+	io.ReadCloser
+	n uint64
+}
+
+// NewCounter wraps r.
+func NewCounter(r io.ReadCloser) *Counter {
+	return &Counter{ReadCloser: r}
+}
+
+func (c *Counter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += uint64(n)
+
+	return n, err
+}
+
+// Count returns the number of bytes read.
+func (c *Counter) Count() uint64 {
+	return c.n
+}
+
+// NewEntry returns an entry with the standard fields of a finished request.
+func NewEntry(r *http.Request, username string, rec *Recorder, received uint64, d time.Duration, err error) Entry {
+	e := Entry{
+		Time:       time.Now().Add(-d),
+		RemoteAddr: r.RemoteAddr,
+		Username:   username,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     rec.Status(),
+		BytesIn:    received,
+		BytesOut:   rec.Size(),
+		Duration:   d.Seconds(),
+		Range:      r.Header.Get("Range"),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.RemoteAddr = host
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	return e
+}
@@ -0,0 +1,445 @@
+// Package annex implements the external special remote protocol of
+// git-annex (https://git-annex.branchable.com/design/external_special_remote_protocol/),
+// storing the content of keys on myCloud.
+package annex
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+var log logger.Log
+
+// DefaultDirectory is the myCloud directory in which keys are stored if the
+// remote is initialized without "directory=...".
+const DefaultDirectory = "/git-annex"
+
+// progressInterval is the minimum interval between PROGRESS messages.
+const progressInterval = 500 * time.Millisecond
+
+// Remote represents a special remote which is controlled by git-annex over
+// a pair of pipes.
+type Remote struct {
+	username string
+	password string
+
+	in  *bufio.Reader
+	mu  sync.Mutex
+	out io.Writer
+
+	mc  *mycloud.MyCloud
+	dir string
+}
+
+// New creates a special remote which logs in to myCloud with the given
+// credentials as soon as git-annex needs it.
+func New(l logger.Log, username string, password string, in io.Reader, out io.Writer) *Remote {
+	log = l
+
+	return &Remote{
+		username: username,
+		password: password,
+		in:       bufio.NewReader(in),
+		out:      out,
+	}
+}
+
+// send writes a message to git-annex.
+func (r *Remote) send(format string, args ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+
+	log.Debug("-> %s", msg)
+
+	if _, err := fmt.Fprintln(r.out, msg); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+
+	return nil
+}
+
+// receive reads a message from git-annex.
+func (r *Remote) receive() (string, error) {
+	line, err := r.in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+
+	log.Debug("<- %s", line)
+
+	return line, nil
+}
+
+// getConfig requests a configuration setting of the remote.
+func (r *Remote) getConfig(name string) (string, error) {
+	if err := r.send("GETCONFIG %s", name); err != nil {
+		return "", err
+	}
+
+	line, err := r.receive()
+	if err != nil {
+		return "", err
+	}
+
+	if line != "VALUE" && !strings.HasPrefix(line, "VALUE ") {
+		return "", fmt.Errorf("unexpected reply to GETCONFIG: %s", line)
+	}
+
+	return strings.TrimPrefix(strings.TrimPrefix(line, "VALUE"), " "), nil
+}
+
+// Serve handles requests of git-annex until it closes the connection.
+func (r *Remote) Serve() error {
+	if err := r.send("VERSION 1"); err != nil {
+		return err
+	}
+
+	for {
+		line, err := r.receive()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read: %v", err)
+		}
+
+		if err := r.handle(line); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles a single request. Only errors of the connection to
+// git-annex are returned, all others are reported to git-annex.
+func (r *Remote) handle(line string) error {
+	fields := strings.SplitN(line, " ", 2)
+	args := ""
+
+	if len(fields) == 2 {
+		args = fields[1]
+	}
+
+	switch fields[0] {
+	case "EXTENSIONS":
+		return r.send("EXTENSIONS")
+	case "INITREMOTE":
+		if err := r.initRemote(); err != nil {
+			return r.send("INITREMOTE-FAILURE %s", oneLine(err))
+		}
+
+		return r.send("INITREMOTE-SUCCESS")
+	case "PREPARE":
+		if err := r.prepare(); err != nil {
+			return r.send("PREPARE-FAILURE %s", oneLine(err))
+		}
+
+		return r.send("PREPARE-SUCCESS")
+	case "GETCOST":
+		return r.send("COST 200")
+	case "GETAVAILABILITY":
+		return r.send("AVAILABILITY GLOBAL")
+	case "TRANSFER":
+		// TRANSFER STORE|RETRIEVE Key File, where File may contain spaces.
+		a := strings.SplitN(args, " ", 3)
+		if len(a) != 3 {
+			return r.send("ERROR invalid TRANSFER request")
+		}
+
+		var err error
+
+		switch a[0] {
+		case "STORE":
+			err = r.store(a[1], a[2])
+		case "RETRIEVE":
+			err = r.retrieve(a[1], a[2])
+		default:
+			return r.send("UNSUPPORTED-REQUEST")
+		}
+
+		if err != nil {
+			return r.send("TRANSFER-FAILURE %s %s %s", a[0], a[1], oneLine(err))
+		}
+
+		return r.send("TRANSFER-SUCCESS %s %s", a[0], a[1])
+	case "CHECKPRESENT":
+		present, err := r.present(args)
+
+		switch {
+		case err != nil:
+			return r.send("CHECKPRESENT-UNKNOWN %s %s", args, oneLine(err))
+		case present:
+			return r.send("CHECKPRESENT-SUCCESS %s", args)
+		}
+
+		return r.send("CHECKPRESENT-FAILURE %s", args)
+	case "REMOVE":
+		if err := r.remove(args); err != nil {
+			return r.send("REMOVE-FAILURE %s %s", args, oneLine(err))
+		}
+
+		return r.send("REMOVE-SUCCESS %s", args)
+	case "ERROR":
+		return fmt.Errorf("git-annex: %s", args)
+	}
+
+	return r.send("UNSUPPORTED-REQUEST")
+}
+
+// oneLine returns the message of err without line breaks, since messages are
+// line-based.
+func oneLine(err error) string {
+	return strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// login logs in to myCloud, unless already logged in.
+func (r *Remote) login() error {
+	if r.mc != nil {
+		return nil
+	}
+
+	mc, err := mycloud.New(r.username, r.password, log)
+	if err != nil {
+		return fmt.Errorf("mycloud.New: %v", err)
+	}
+
+	r.mc = mc
+
+	return nil
+}
+
+// directory returns the configured directory, or DefaultDirectory.
+func (r *Remote) directory() (string, error) {
+	dir, err := r.getConfig("directory")
+	if err != nil {
+		return "", err
+	}
+
+	if dir == "" {
+		dir = DefaultDirectory
+	}
+
+	return path.Clean("/" + dir), nil
+}
+
+// initRemote creates the directory of the remote.
+func (r *Remote) initRemote() error {
+	dir, err := r.directory()
+	if err != nil {
+		return err
+	}
+
+	if err := r.login(); err != nil {
+		return err
+	}
+
+	if err := r.mc.CreateDirectory(dir + "/"); err != nil && mycloud.StatusCode(err) != http.StatusConflict {
+		return fmt.Errorf("unable to create %s: %v", dir, err)
+	}
+
+	return nil
+}
+
+// prepare logs in and reads the configuration.
+func (r *Remote) prepare() error {
+	dir, err := r.directory()
+	if err != nil {
+		return err
+	}
+
+	if err := r.login(); err != nil {
+		return err
+	}
+
+	r.dir = dir
+
+	return nil
+}
+
+// prepared returns an error if the remote has not been prepared yet.
+func (r *Remote) prepared() error {
+	if r.mc == nil {
+		return fmt.Errorf("remote not prepared")
+	}
+
+	return nil
+}
+
+// keyPath returns the myCloud path of a key. Keys are stored in two levels
+// of directories named after the MD5 sum of the key, like the "hashdirlower"
+// layout of git-annex (e.g. "/git-annex/f87/4d5/<key>").
+func (r *Remote) keyPath(key string) string {
+	sum := md5.Sum([]byte(key))
+	h := hex.EncodeToString(sum[:])
+
+	return path.Join(r.dir, h[0:3], h[3:6], key)
+}
+
+// stat returns the size of the key and whether it is present.
+func (r *Remote) stat(key string) (int64, bool, error) {
+	if err := r.prepared(); err != nil {
+		return 0, false, err
+	}
+
+	p := r.keyPath(key)
+
+	m, err := r.mc.Metadata(path.Dir(p) + "/")
+	if err != nil {
+		if mycloud.StatusCode(err) == http.StatusNotFound {
+			return 0, false, nil
+		}
+
+		return 0, false, err
+	}
+
+	for _, f := range m.Files {
+		if f.Name == path.Base(p) {
+			return int64(f.Length), true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// present checks whether the key is stored.
+func (r *Remote) present(key string) (bool, error) {
+	_, ok, err := r.stat(key)
+
+	return ok, err
+}
+
+// store uploads the file fn as key. The size of the stored file is checked
+// afterwards (its content is not), incomplete files are removed.
+func (r *Remote) store(key string, fn string) error {
+	if err := r.prepared(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	p := r.keyPath(key)
+
+	if err := r.mc.CreateFile(p, &progress{Reader: f, r: r}); err != nil {
+		r.mc.Delete([]string{p})
+		return fmt.Errorf("upload failed: %v", err)
+	}
+
+	size, ok, err := r.stat(key)
+	if err != nil {
+		return fmt.Errorf("unable to verify upload: %v", err)
+	}
+
+	if !ok || size != fi.Size() {
+		r.mc.Delete([]string{p})
+		return fmt.Errorf("upload incomplete: stored %d of %d bytes", size, fi.Size())
+	}
+
+	return nil
+}
+
+// retrieve downloads key to the file fn.
+func (r *Remote) retrieve(key string, fn string) error {
+	if err := r.prepared(); err != nil {
+		return err
+	}
+
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+
+	err = r.mc.GetFile(r.keyPath(key), &progress{Writer: f, r: r}, "")
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		// git-annex must not see a partial file.
+		os.Remove(fn)
+		return fmt.Errorf("download failed: %v", err)
+	}
+
+	return nil
+}
+
+// remove removes the key. Removing a key which is not present succeeds.
+func (r *Remote) remove(key string) error {
+	ok, err := r.present(key)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return nil
+	}
+
+	if err := r.mc.Delete([]string{r.keyPath(key)}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// progress reports the number of bytes read or written to git-annex.
+type progress struct {
+	io.Reader
+	io.Writer
+	r    *Remote
+	n    int64
+	last time.Time
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.report(n)
+
+	return n, err
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	p.report(n)
+
+	return n, err
+}
+
+// report adds n bytes and sends a PROGRESS message if the last one has been
+// sent more than progressInterval ago.
+func (p *progress) report(n int) {
+	p.n += int64(n)
+
+	if time.Since(p.last) < progressInterval {
+		return
+	}
+
+	p.last = time.Now()
+
+	if err := p.r.send("PROGRESS %d", p.n); err != nil {
+		log.Error("%v", err)
+	}
+}
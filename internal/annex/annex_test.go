@@ -0,0 +1,162 @@
+package annex
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/virvum/scmc/pkg/logger"
+)
+
+func newRemote(in string) (*Remote, *bytes.Buffer) {
+	out := new(bytes.Buffer)
+
+	return New(logger.New(logger.Error, false, ""), "user", "password", strings.NewReader(in), out), out
+}
+
+func TestServe(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		out  []string
+		err  string
+	}{
+		{
+			name: "no requests",
+		},
+		{
+			name: "extensions",
+			in:   []string{"EXTENSIONS INFO ASYNC"},
+			out:  []string{"EXTENSIONS"},
+		},
+		{
+			name: "cost and availability",
+			in:   []string{"GETCOST", "GETAVAILABILITY"},
+			out:  []string{"COST 200", "AVAILABILITY GLOBAL"},
+		},
+		{
+			name: "unsupported requests",
+			in:   []string{"WHEREIS KEY", "TRANSFER MOVE KEY file", ""},
+			out:  []string{"UNSUPPORTED-REQUEST", "UNSUPPORTED-REQUEST", "UNSUPPORTED-REQUEST"},
+		},
+		{
+			name: "invalid transfer",
+			in:   []string{"TRANSFER STORE", "TRANSFER STORE KEY"},
+			out:  []string{"ERROR invalid TRANSFER request", "ERROR invalid TRANSFER request"},
+		},
+		{
+			name: "requests before prepare",
+			in: []string{
+				"TRANSFER STORE KEY /tmp/file with spaces",
+				"TRANSFER RETRIEVE KEY file",
+				"CHECKPRESENT KEY",
+				"REMOVE KEY",
+			},
+			out: []string{
+				"TRANSFER-FAILURE STORE KEY remote not prepared",
+				"TRANSFER-FAILURE RETRIEVE KEY remote not prepared",
+				"CHECKPRESENT-UNKNOWN KEY remote not prepared",
+				"REMOVE-FAILURE KEY remote not prepared",
+			},
+		},
+		{
+			name: "carriage returns",
+			in:   []string{"GETCOST\r"},
+			out:  []string{"COST 200"},
+		},
+		{
+			name: "error",
+			in:   []string{"ERROR something went wrong", "GETCOST"},
+			err:  "git-annex: something went wrong",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := ""
+
+			for _, line := range test.in {
+				in += line + "\n"
+			}
+
+			r, out := newRemote(in)
+
+			err := r.Serve()
+
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case test.err != "" && (err == nil || err.Error() != test.err):
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+
+			expected := strings.Join(append([]string{"VERSION 1"}, test.out...), "\n") + "\n"
+
+			if out.String() != expected {
+				t.Errorf("got output\n%s\nexpected\n%s", out, expected)
+			}
+		})
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	tests := []struct {
+		reply string
+		dir   string
+		err   bool
+	}{
+		{reply: "VALUE", dir: DefaultDirectory},
+		{reply: "VALUE ", dir: DefaultDirectory},
+		{reply: "VALUE annex", dir: "/annex"},
+		{reply: "VALUE /backup/annex/", dir: "/backup/annex"},
+		{reply: "VALUE ../annex", dir: "/annex"},
+		{reply: "VALUE my annex", dir: "/my annex"},
+		{reply: "VALUES annex", err: true},
+		{reply: "ERROR no config", err: true},
+		{reply: "", err: true},
+	}
+
+	for _, test := range tests {
+		r, out := newRemote(test.reply + "\n")
+
+		dir, err := r.directory()
+
+		if (err != nil) != test.err {
+			t.Errorf("reply %q: unexpected error %v", test.reply, err)
+		} else if dir != test.dir {
+			t.Errorf("reply %q: got directory %q, expected %q", test.reply, dir, test.dir)
+		}
+
+		if out.String() != "GETCONFIG directory\n" {
+			t.Errorf("reply %q: unexpected request %q", test.reply, out)
+		}
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	r, _ := newRemote("")
+	r.dir = DefaultDirectory
+
+	// The MD5 sum of "foo" is acbd18db4cc2f85cedef654fccc4a4d8.
+	if p := r.keyPath("foo"); p != "/git-annex/acb/d18/foo" {
+		t.Errorf("got %q", p)
+	}
+}
+
+func TestOneLine(t *testing.T) {
+	tests := []struct {
+		err string
+		msg string
+	}{
+		{"failed", "failed"},
+		{"failed:\nno space left", "failed: no space left"},
+		{"  failed \r\n\tbadly\n", "failed badly"},
+	}
+
+	for _, test := range tests {
+		if msg := oneLine(errors.New(test.err)); msg != test.msg {
+			t.Errorf("oneLine(%q) = %q, expected %q", test.err, msg, test.msg)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Package browse implements a read-only HTTP server which renders listings
+// of a myCloud directory as HTML or JSON and serves the files below it.
+package browse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/drive"
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+var log logger.Log
+
+// Options represents options of the handler.
+type Options struct {
+	// Root is the myCloud directory which is served.
+	Root string
+	// ListTTL is the duration for which directory listings are cached.
+	ListTTL time.Duration
+	// AccessLog, if set, receives an entry for each request. Otherwise
+	// requests are logged as informational messages.
+	AccessLog *accesslog.Logger
+}
+
+// Handler serves a myCloud directory read-only.
+type Handler struct {
+	mc    *mycloud.MyCloud
+	o     Options
+	cache *drive.Cache
+}
+
+// httpError is an error with an HTTP status code.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+
+	return http.StatusText(e.status)
+}
+
+var (
+	errNotFound         = &httpError{status: http.StatusNotFound}
+	errForbidden        = &httpError{status: http.StatusForbidden}
+	errMethodNotAllowed = &httpError{status: http.StatusMethodNotAllowed}
+)
+
+// NewHandler creates a handler which serves the directory o.Root of the
+// given myCloud session.
+func NewHandler(l logger.Log, mc *mycloud.MyCloud, o Options) *Handler {
+	log = l
+
+	o.Root = path.Clean("/" + o.Root)
+
+	return &Handler{
+		mc:    mc,
+		o:     o,
+		cache: drive.NewCache(mc, o.ListTTL),
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		start = time.Now()
+		rec   = accesslog.NewRecorder(w)
+		err   error
+	)
+
+	defer func() {
+		h.logRequest(r, rec, time.Since(start), err)
+	}()
+
+	if err = h.serve(rec, r); err != nil && !rec.Written() {
+		status := http.StatusInternalServerError
+
+		if e, ok := err.(*httpError); ok {
+			status = e.status
+		} else {
+			log.Error("%s %s: %v", r.Method, r.URL.Path, err)
+		}
+
+		if status == http.StatusMethodNotAllowed {
+			rec.Header().Set("Allow", "GET, HEAD")
+		}
+
+		http.Error(rec, http.StatusText(status), status)
+	}
+}
+
+// serve serves a directory listing or a file.
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return errMethodNotAllowed
+	}
+
+	// The URL path is relative to the root, hence clients cannot leave it.
+	rel := path.Clean("/" + r.URL.Path)
+	p := path.Join(h.o.Root, rel)
+
+	e, err := h.stat(p)
+	if err != nil {
+		return err
+	}
+
+	if !e.Dir {
+		return h.serveFile(w, r, p, e)
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		u := *r.URL
+		u.Path += "/"
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+
+		return nil
+	}
+
+	return h.serveDir(w, r, p, rel)
+}
+
+// stat returns the entry of the cleaned path p.
+func (h *Handler) stat(p string) (*drive.Entry, error) {
+	if p == h.o.Root {
+		return &drive.Entry{Name: path.Base(p), Dir: true}, nil
+	}
+
+	e, err := h.cache.Stat(p)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	return e, nil
+}
+
+// serveFile streams a file. Range requests are passed to myCloud.
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, p string, e *drive.Entry) error {
+	mtime := e.MTime.UTC().Truncate(time.Second)
+
+	w.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if e.ETag != "" {
+		w.Header().Set("ETag", `"`+strings.Trim(e.ETag, `"`)+`"`)
+	}
+
+	if e.MIME != "" {
+		w.Header().Set("Content-Type", e.MIME)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !mtime.After(t) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	httpRange := r.Header.Get("Range")
+
+	// A range of a modified file is not served, but the whole file.
+	if ir := r.Header.Get("If-Range"); ir != "" && ir != w.Header().Get("ETag") && ir != w.Header().Get("Last-Modified") {
+		httpRange = ""
+	}
+
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+		w.WriteHeader(http.StatusOK)
+
+		return nil
+	}
+
+	response, err := h.mc.OpenFile(p, httpRange)
+	if err != nil {
+		return mapError(err)
+	}
+
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		w.Header().Set("Content-Range", response.Header.Get("Content-Range"))
+	case http.StatusRequestedRangeNotSatisfiable:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", e.Size))
+		return &httpError{status: http.StatusRequestedRangeNotSatisfiable}
+	case http.StatusNotFound:
+		return errNotFound
+	default:
+		return fmt.Errorf("got status code %d from myCloud", response.StatusCode)
+	}
+
+	if response.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+	}
+
+	w.WriteHeader(response.StatusCode)
+
+	if _, err := io.Copy(w, response.Body); err != nil {
+		return fmt.Errorf("io.Copy: %v", err)
+	}
+
+	return nil
+}
+
+// serveDir renders the listing of the directory p, which is served at the
+// URL path rel, as HTML or, if requested with "?format=json" or an Accept
+// header of "application/json", as JSON.
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, p string, rel string) error {
+	entries, err := h.cache.List(p)
+	if err != nil {
+		return mapError(err)
+	}
+
+	q := r.URL.Query()
+
+	var (
+		by   = q.Get("sort")
+		desc = q.Get("order") == "desc"
+	)
+
+	sorted := make([]*drive.Entry, 0, len(entries))
+
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+
+	sortEntries(sorted, by, desc)
+
+	if q.Get("format") == "json" || strings.HasPrefix(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method == http.MethodHead {
+			return nil
+		}
+
+		return json.NewEncoder(w).Encode(sorted)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	return listingTemplate.Execute(w, &page{
+		Path:    drive.DirPath(rel),
+		Root:    rel == "/",
+		Entries: sorted,
+		Sort:    by,
+		Desc:    desc,
+	})
+}
+
+// sortEntries sorts entries by name, size or modification time, with
+// directories first.
+func sortEntries(entries []*drive.Entry, by string, desc bool) {
+	less := func(a, b *drive.Entry) bool {
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.MTime.Equal(b.MTime) {
+				return a.MTime.Before(b.MTime)
+			}
+		}
+
+		return a.Name < b.Name
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+
+		if desc {
+			return less(b, a)
+		}
+
+		return less(a, b)
+	})
+}
+
+// mapError maps errors returned by the myCloud API to HTTP errors.
+func mapError(err error) error {
+	if err == os.ErrNotExist {
+		return errNotFound
+	}
+
+	switch mycloud.StatusCode(err) {
+	case http.StatusNotFound:
+		return errNotFound
+	case http.StatusForbidden:
+		return errForbidden
+	}
+
+	return err
+}
+
+// logRequest writes a request to the access log or, if the access log is
+// disabled, logs it as informational message.
+func (h *Handler) logRequest(r *http.Request, rec *accesslog.Recorder, d time.Duration, err error) {
+	if h.o.AccessLog != nil {
+		h.o.AccessLog.Log(accesslog.NewEntry(r, "", rec, 0, d, err))
+		return
+	}
+
+	result := "OK"
+
+	if err != nil {
+		result = fmt.Sprintf("error: %s", err)
+	}
+
+	if httpRange := r.Header.Get("Range"); httpRange != "" {
+		log.Info("%s %s %s -> %d %s", r.Method, r.URL.Path, httpRange, rec.Status(), result)
+	} else {
+		log.Info("%s %s -> %d %s", r.Method, r.URL.Path, rec.Status(), result)
+	}
+}
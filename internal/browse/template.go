@@ -0,0 +1,129 @@
+package browse
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"time"
+
+	"github.com/virvum/scmc/internal/drive"
+)
+
+// page is the data of the listing template.
+type page struct {
+	Path    string
+	Root    bool
+	Entries []*drive.Entry
+	Sort    string
+	Desc    bool
+}
+
+// SortLink returns the query string which sorts the listing by the given
+// column, reversing the order if it is already sorted by it.
+func (p *page) SortLink(by string) string {
+	order := "asc"
+
+	if p.sortedBy(by) && !p.Desc {
+		order = "desc"
+	}
+
+	return "?sort=" + by + "&order=" + order
+}
+
+// Arrow returns an arrow indicating the order if the listing is sorted by
+// the given column.
+func (p *page) Arrow(by string) string {
+	switch {
+	case !p.sortedBy(by):
+		return ""
+	case p.Desc:
+		return " ↓"
+	}
+
+	return " ↑"
+}
+
+func (p *page) sortedBy(by string) bool {
+	return p.Sort == by || (p.Sort == "" && by == "name")
+}
+
+// href returns the relative link to an entry.
+func href(e *drive.Entry) string {
+	u := &url.URL{Path: e.Name}
+
+	if e.Dir {
+		return u.String() + "/"
+	}
+
+	return u.String()
+}
+
+// humanSize formats a size in bytes using binary prefixes.
+func humanSize(b int64) string {
+	const unit = 1024
+
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"href": href,
+	"size": humanSize,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em; text-align: left; }
+th a { color: inherit; }
+td.size { text-align: right; }
+tr:hover { background: #eee; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<thead>
+<tr>
+<th><a href="{{.SortLink "name"}}">Name{{.Arrow "name"}}</a></th>
+<th><a href="{{.SortLink "size"}}">Size{{.Arrow "size"}}</a></th>
+<th><a href="{{.SortLink "mtime"}}">Modified{{.Arrow "mtime"}}</a></th>
+</tr>
+</thead>
+<tbody>
+{{- if not .Root}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr>
+<td><a href="{{href .}}">{{.Name}}{{if .Dir}}/{{end}}</a></td>
+<td class="size">{{if not .Dir}}{{size .Size}}{{end}}</td>
+<td>{{time .MTime}}</td>
+</tr>
+{{- end}}
+</tbody>
+</table>
+</body>
+</html>
+`))
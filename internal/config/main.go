@@ -14,6 +14,19 @@ type Config struct {
 	Username string
 	Password string
 	LogLevel logger.Level
+	Accounts []Account
+}
+
+// Account represents a myCloud account known to the servers provided by scmc.
+type Account struct {
+	Username string
+	Password string
+	// ReadOnly restricts the account to read operations.
+	ReadOnly bool
+	// AccessKeyID and SecretAccessKey are the S3 credentials which are
+	// mapped to the account by the S3 gateway.
+	AccessKeyID     string
+	SecretAccessKey string
 }
 
 // Load loads the configuration from the given configuration file into type Config.
@@ -0,0 +1,262 @@
+// Package davfs implements a WebDAV server which maps the myCloud Drive of
+// each authenticated user, using golang.org/x/net/webdav.
+package davfs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/virvum/scmc/internal/drive"
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"golang.org/x/net/webdav"
+)
+
+// errPartialWrite is returned when a file is opened for writing without
+// being truncated, since myCloud only stores whole files.
+var errPartialWrite = errors.New("files can only be written as a whole")
+
+// FS implements webdav.FileSystem on top of a myCloud session.
+type FS struct {
+	mc       *mycloud.MyCloud
+	cache    *drive.Cache
+	readOnly bool
+}
+
+// NewFS creates a file system backed by the given myCloud session. Directory
+// listings are cached for ttl. If readOnly is true, all modifications are
+// rejected with os.ErrPermission.
+func NewFS(mc *mycloud.MyCloud, ttl time.Duration, readOnly bool) *FS {
+	return &FS{
+		mc:       mc,
+		cache:    drive.NewCache(mc, ttl),
+		readOnly: readOnly,
+	}
+}
+
+// clean returns the absolute path of name without trailing slash.
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// stat returns the entry of the cleaned path p.
+func (f *FS) stat(p string) (*drive.Entry, error) {
+	e, err := f.cache.Stat(p)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	return e, nil
+}
+
+// parent checks whether the parent directory of p exists, since myCloud
+// creates missing parents, which WebDAV clients do not expect.
+func (f *FS) parent(p string) error {
+	return mapError(f.cache.Parent(p))
+}
+
+// Mkdir creates a directory.
+func (f *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if f.readOnly {
+		return os.ErrPermission
+	}
+
+	p := clean(name)
+
+	if _, err := f.stat(p); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := f.parent(p); err != nil {
+		return err
+	}
+
+	if err := f.mc.CreateDirectory(drive.DirPath(p)); err != nil {
+		return mapError(err)
+	}
+
+	f.cache.Invalidate(path.Dir(p))
+
+	return nil
+}
+
+// OpenFile opens a file or directory. Files can either be read or written
+// as a whole, in which case they are uploaded while they are written.
+func (f *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	var (
+		p       = clean(name)
+		fi, err = f.stat(p)
+	)
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		switch {
+		case err != nil:
+			return nil, err
+		case fi.Dir:
+			return &dir{fs: f, path: p, fi: fi}, nil
+		}
+
+		return &readFile{fs: f, path: p, fi: fi}, nil
+	}
+
+	if f.readOnly {
+		return nil, os.ErrPermission
+	}
+
+	switch {
+	case err == nil && fi.Dir:
+		return nil, os.ErrInvalid
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case err == nil && flag&os.O_TRUNC == 0 && fi.Size > 0:
+		return nil, errPartialWrite
+	case os.IsNotExist(err) && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+
+	if err := f.parent(p); err != nil {
+		return nil, err
+	}
+
+	u, _ := ctx.Value(uploadKey{}).(*upload)
+
+	return newWriteFile(f, p, u), nil
+}
+
+// RemoveAll removes a file or a directory with all its contents.
+func (f *FS) RemoveAll(ctx context.Context, name string) error {
+	if f.readOnly {
+		return os.ErrPermission
+	}
+
+	p := clean(name)
+
+	if p == "/" {
+		return os.ErrPermission
+	}
+
+	fi, err := f.stat(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	target := p
+
+	if fi.Dir {
+		target = drive.DirPath(p)
+	}
+
+	if err := f.mc.Delete([]string{target}); err != nil {
+		return mapError(err)
+	}
+
+	f.cache.Invalidate(path.Dir(p))
+	f.cache.Forget(p)
+
+	return nil
+}
+
+// Rename moves a file or directory. Since myCloud cannot move files, they
+// are copied and removed afterwards.
+func (f *FS) Rename(ctx context.Context, oldName string, newName string) error {
+	if f.readOnly {
+		return os.ErrPermission
+	}
+
+	var (
+		src = clean(oldName)
+		dst = clean(newName)
+	)
+
+	if src == "/" || dst == "/" || strings.HasPrefix(dst, drive.DirPath(src)) {
+		return os.ErrInvalid
+	}
+
+	fi, err := f.stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := f.parent(dst); err != nil {
+		return err
+	}
+
+	if fi.Dir {
+		err = drive.MoveDir(f.mc, src, dst)
+	} else {
+		err = f.mc.Move(src, dst)
+	}
+
+	f.cache.Invalidate(path.Dir(src), path.Dir(dst))
+	f.cache.Forget(src)
+	f.cache.Forget(dst)
+
+	return mapError(err)
+}
+
+// Stat returns the file info of a file or directory.
+func (f *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	e, err := f.stat(clean(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileInfo(e), nil
+}
+
+// mapError maps errors returned by the myCloud API to the errors of the os
+// package expected by the WebDAV handler.
+func mapError(err error) error {
+	switch mycloud.StatusCode(err) {
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	case http.StatusForbidden:
+		return os.ErrPermission
+	case http.StatusConflict:
+		return os.ErrExist
+	}
+
+	return err
+}
+
+// fileInfo implements os.FileInfo along with webdav.ETager and
+// webdav.ContentTyper, so that the values provided by myCloud are used.
+type fileInfo struct {
+	os.FileInfo
+	etag string
+	mime string
+}
+
+// newFileInfo returns the file info of an entry.
+func newFileInfo(e *drive.Entry) *fileInfo {
+	return &fileInfo{FileInfo: e.Info(), etag: e.ETag, mime: e.MIME}
+}
+
+// ETag returns the ETag of the file as provided by myCloud.
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+
+	return `"` + strings.Trim(fi.etag, `"`) + `"`, nil
+}
+
+// ContentType returns the MIME type of the file as provided by myCloud.
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.mime == "" {
+		return "", webdav.ErrNotImplemented
+	}
+
+	return fi.mime, nil
+}
@@ -0,0 +1,257 @@
+package davfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/virvum/scmc/internal/drive"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+var (
+	errNotDir  = errors.New("not a directory")
+	errIsDir   = errors.New("is a directory")
+	errNotRead = errors.New("file is not opened for reading")
+	errNoWrite = errors.New("file is not opened for writing")
+)
+
+// readFile is a file opened for reading. Data is streamed from myCloud,
+// starting at the current offset; seeking to another offset starts a new
+// ranged request.
+type readFile struct {
+	fs   *FS
+	path string
+	fi   *drive.Entry
+	off  int64
+
+	body    io.ReadCloser
+	bodyOff int64
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if f.off >= f.fi.Size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil || f.bodyOff != f.off {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	f.bodyOff += int64(n)
+
+	return n, err
+}
+
+// open requests the file starting at the current offset.
+func (f *readFile) open() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+
+	response, err := f.fs.mc.OpenFile(f.path, fmt.Sprintf("bytes=%d-", f.off))
+	if err != nil {
+		return mapError(err)
+	}
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The range was ignored, the body contains the whole file.
+		if _, err := io.CopyN(ioutil.Discard, response.Body, f.off); err != nil {
+			response.Body.Close()
+			return fmt.Errorf("io.CopyN: %v", err)
+		}
+	case http.StatusNotFound:
+		response.Body.Close()
+		return os.ErrNotExist
+	default:
+		response.Body.Close()
+		return &mycloud.StatusError{Code: response.StatusCode, Expected: http.StatusPartialContent}
+	}
+
+	f.body, f.bodyOff = response.Body, f.off
+
+	return nil
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.fi.Size
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	f.off = offset
+
+	return offset, nil
+}
+
+func (f *readFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+
+	return nil
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) { return nil, errNotDir }
+func (f *readFile) Stat() (os.FileInfo, error)               { return newFileInfo(f.fi), nil }
+func (f *readFile) Write(p []byte) (int, error)              { return 0, errNoWrite }
+
+// writeFile is a file opened for writing. Data is uploaded while it is
+// written, the upload completes when the file is closed. If the file is
+// written from the body of a PUT request which has not been received
+// completely, the upload is aborted instead, so that the existing file is
+// not replaced with truncated content.
+type writeFile struct {
+	fs     *FS
+	path   string
+	upload *upload
+	pw     *io.PipeWriter
+	done   chan error
+	size   int64
+}
+
+// newWriteFile starts the upload of the file at p. u is the body of the PUT
+// request, if any.
+func newWriteFile(fs *FS, p string, u *upload) *writeFile {
+	var (
+		pr, pw = io.Pipe()
+		f      = &writeFile{fs: fs, path: p, upload: u, pw: pw, done: make(chan error, 1)}
+	)
+
+	go func() {
+		err := fs.mc.CreateFile(p, pr)
+
+		// Writes fail instead of blocking if the upload ended prematurely.
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+
+		f.done <- err
+	}()
+
+	return f
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	n, err := f.pw.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close completes the upload, or aborts it if the body of the request is
+// incomplete.
+func (f *writeFile) Close() error {
+	if f.upload != nil {
+		if err := f.upload.complete(); err != nil {
+			f.pw.CloseWithError(fmt.Errorf("upload aborted: %v", err))
+			<-f.done
+
+			return fmt.Errorf("upload of %s aborted: %v", f.path, err)
+		}
+	}
+
+	f.pw.Close()
+
+	err := <-f.done
+
+	f.fs.cache.Invalidate(path.Dir(f.path))
+
+	return mapError(err)
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	return newFileInfo(&drive.Entry{Name: path.Base(f.path), Size: f.size, MTime: time.Now()}), nil
+}
+
+func (f *writeFile) Read(p []byte) (int, error)                   { return 0, errNotRead }
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) { return 0, errNotRead }
+func (f *writeFile) Readdir(count int) ([]os.FileInfo, error)     { return nil, errNotDir }
+
+// dir is an opened directory.
+type dir struct {
+	fs      *FS
+	path    string
+	fi      *drive.Entry
+	entries []os.FileInfo
+	loaded  bool
+}
+
+// Readdir returns the next count entries of the directory (all remaining
+// entries if count is not positive), sorted by name.
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.loaded {
+		entries, err := d.fs.cache.List(d.path)
+		if err != nil {
+			return nil, mapError(err)
+		}
+
+		for _, e := range entries {
+			d.entries = append(d.entries, newFileInfo(e))
+		}
+
+		sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+
+		d.loaded = true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+
+	return entries, nil
+}
+
+// Seek only supports rewinding the directory.
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, os.ErrInvalid
+	}
+
+	d.entries, d.loaded = nil, false
+
+	return 0, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error)  { return newFileInfo(d.fi), nil }
+func (d *dir) Read(p []byte) (int, error)  { return 0, errIsDir }
+func (d *dir) Write(p []byte) (int, error) { return 0, errIsDir }
+func (d *dir) Close() error                { return nil }
@@ -0,0 +1,221 @@
+package davfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/sessions"
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"golang.org/x/net/webdav"
+)
+
+var log logger.Log
+
+// Options represents options of the WebDAV handler.
+type Options struct {
+	// Prefix is the URL path prefix which is stripped from all requests.
+	Prefix string
+	// ListTTL is the duration for which directory listings are cached.
+	ListTTL time.Duration
+	// ReadOnly rejects all modifications.
+	ReadOnly bool
+	// ReadOnlyUsers are users which may not modify anything.
+	ReadOnlyUsers []string
+	// AccessLog, if set, receives an entry for each request. Otherwise
+	// requests are logged as informational messages.
+	AccessLog *accesslog.Logger
+}
+
+// Handler serves the myCloud Drive of each user via WebDAV. Users
+// authenticate with their myCloud credentials (HTTP basic authentication).
+type Handler struct {
+	o             Options
+	sessions      *sessions.Pool
+	readOnlyUsers map[string]bool
+
+	mu       sync.Mutex
+	handlers map[string]*userHandler
+}
+
+// userHandler is the WebDAV handler of a single user.
+type userHandler struct {
+	mc *mycloud.MyCloud
+	h  *webdav.Handler
+}
+
+// errKey is the context key of the error of a request, which is reported by
+// the WebDAV handler via its logger.
+type errKey struct{}
+
+// uploadKey is the context key of the body of a PUT request, which is
+// checked before the uploaded file is committed.
+type uploadKey struct{}
+
+// upload is the body of a PUT request. Read errors are kept, since the WebDAV
+// handler closes the file even if the body could not be read completely.
+type upload struct {
+	r      io.ReadCloser
+	length int64
+	n      int64
+	err    error
+}
+
+func (u *upload) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.n += int64(n)
+
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+
+	return n, err
+}
+
+// Close closes the request body.
+func (u *upload) Close() error {
+	return u.r.Close()
+}
+
+// complete returns an error if the body has not been received completely,
+// e.g. because the client aborted the request.
+func (u *upload) complete() error {
+	switch {
+	case u.err != nil:
+		return u.err
+	case u.length >= 0 && u.n != u.length:
+		return fmt.Errorf("received %d of %d bytes", u.n, u.length)
+	}
+
+	return nil
+}
+
+// writeMethods are the methods which modify resources.
+var writeMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"MKCOL":           true,
+	"COPY":            true,
+	"MOVE":            true,
+	"PROPPATCH":       true,
+	"LOCK":            true,
+	"UNLOCK":          true,
+}
+
+// NewHandler creates a WebDAV handler.
+func NewHandler(l logger.Log, o Options) *Handler {
+	log = l
+
+	h := &Handler{
+		o:             o,
+		sessions:      sessions.New(l),
+		readOnlyUsers: make(map[string]bool),
+		handlers:      make(map[string]*userHandler),
+	}
+
+	for _, u := range o.ReadOnlyUsers {
+		h.readOnlyUsers[u] = true
+	}
+
+	return h
+}
+
+// handler returns the WebDAV handler of the given user, creating a new one if
+// the user logged in again.
+func (h *Handler) handler(username string, mc *mycloud.MyCloud) *webdav.Handler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if u, ok := h.handlers[username]; ok && u.mc == mc {
+		return u.h
+	}
+
+	u := &userHandler{
+		mc: mc,
+		h: &webdav.Handler{
+			Prefix:     h.o.Prefix,
+			FileSystem: NewFS(mc, h.o.ListTTL, h.o.ReadOnly || h.readOnlyUsers[username]),
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if p, ok := r.Context().Value(errKey{}).(*error); ok {
+					*p = err
+				}
+			},
+		},
+	}
+
+	h.handlers[username] = u
+
+	return u.h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		start = time.Now()
+		rec   = accesslog.NewRecorder(w)
+		body  = accesslog.NewCounter(r.Body)
+		err   error
+
+		username, password, ok = r.BasicAuth()
+	)
+
+	r.Body = body
+
+	defer func() {
+		h.logRequest(r, username, rec, body.Count(), time.Since(start), err)
+	}()
+
+	if !ok {
+		rec.Header().Set("WWW-Authenticate", `Basic realm="myCloud"`)
+		http.Error(rec, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	mc, loginErr := h.sessions.Login(username, password)
+	if loginErr != nil {
+		err = fmt.Errorf("authorization failed: %v", loginErr)
+		log.Error("%v", err)
+		rec.Header().Set("WWW-Authenticate", `Basic realm="myCloud"`)
+		http.Error(rec, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if writeMethods[r.Method] && (h.o.ReadOnly || h.readOnlyUsers[username]) {
+		err = fmt.Errorf("read-only mode: write operation rejected")
+		http.Error(rec, "myCloud Drive is read-only", http.StatusForbidden)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), errKey{}, &err)
+
+	if r.Method == http.MethodPut {
+		u := &upload{r: r.Body, length: r.ContentLength}
+		r.Body = u
+		ctx = context.WithValue(ctx, uploadKey{}, u)
+	}
+
+	h.handler(username, mc).ServeHTTP(rec, r.WithContext(ctx))
+}
+
+// logRequest writes a request to the access log or, if the access log is
+// disabled, logs it as informational message.
+func (h *Handler) logRequest(r *http.Request, username string, rec *accesslog.Recorder, received uint64, d time.Duration, err error) {
+	if h.o.AccessLog != nil {
+		h.o.AccessLog.Log(accesslog.NewEntry(r, username, rec, received, d, err))
+		return
+	}
+
+	result := "OK"
+
+	if err != nil {
+		result = fmt.Sprintf("error: %s", err)
+	}
+
+	log.Info("%s %s -> %d %s", r.Method, r.URL, rec.Status(), result)
+}
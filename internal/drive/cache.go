@@ -0,0 +1,190 @@
+package drive
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// Cache caches the directory listings of a myCloud session. Directories are
+// given by their path, with or without trailing slash. Errors are returned
+// as returned by the myCloud API, so that callers can map them.
+type Cache struct {
+	mc  *mycloud.MyCloud
+	ttl time.Duration
+
+	// Keep, if set, is called with the path of each entry which is missing
+	// when a directory is listed again. Entries for which it returns true
+	// are kept, e.g. files which have been created but not uploaded yet.
+	// It is called while the cache is locked and must not use it.
+	Keep func(p string) bool
+
+	mu       sync.Mutex
+	listings map[string]*listing
+}
+
+// listing is a cached directory listing.
+type listing struct {
+	time    time.Time
+	entries map[string]*Entry
+}
+
+// NewCache creates a cache which keeps listings for ttl.
+func NewCache(mc *mycloud.MyCloud, ttl time.Duration) *Cache {
+	return &Cache{
+		mc:       mc,
+		ttl:      ttl,
+		listings: make(map[string]*listing),
+	}
+}
+
+// List returns the entries of the directory dir by name, using the cached
+// listing if it is recent enough. The returned map is a copy, the entries
+// must not be modified.
+func (c *Cache) List(dir string) (map[string]*Entry, error) {
+	dir = DirPath(dir)
+
+	c.mu.Lock()
+	if l, ok := c.listings[dir]; ok && time.Since(l.time) < c.ttl {
+		defer c.mu.Unlock()
+		return l.copy(), nil
+	}
+	c.mu.Unlock()
+
+	m, err := c.mc.Metadata(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listing{
+		time:    time.Now(),
+		entries: make(map[string]*Entry),
+	}
+
+	for _, d := range m.Directories {
+		l.entries[d.Name] = &Entry{
+			Name:  d.Name,
+			Dir:   true,
+			MTime: d.ModificationTime,
+			CTime: d.CreationTime,
+		}
+	}
+
+	for _, file := range m.Files {
+		l.entries[file.Name] = &Entry{
+			Name:  file.Name,
+			Size:  int64(file.Length),
+			MTime: file.ModificationTime,
+			CTime: file.CreationTime,
+			MIME:  file.Mime,
+			ETag:  file.Etag,
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.listings[dir]; ok && c.Keep != nil {
+		for name, e := range old.entries {
+			if _, ok := l.entries[name]; !ok && c.Keep(dir+name) {
+				l.entries[name] = e
+			}
+		}
+	}
+
+	c.listings[dir] = l
+
+	return l.copy(), nil
+}
+
+// copy returns a copy of the entries of the listing. c.mu must be held.
+func (l *listing) copy() map[string]*Entry {
+	entries := make(map[string]*Entry, len(l.entries))
+
+	for name, e := range l.entries {
+		entries[name] = e
+	}
+
+	return entries
+}
+
+// Stat returns the entry of the file or directory p, or os.ErrNotExist if
+// it does not exist.
+func (c *Cache) Stat(p string) (*Entry, error) {
+	p = path.Clean("/" + p)
+
+	if p == "/" {
+		return &Entry{Name: "/", Dir: true}, nil
+	}
+
+	entries, err := c.List(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := entries[path.Base(p)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return e, nil
+}
+
+// Parent returns os.ErrNotExist unless the parent directory of p exists,
+// since myCloud creates missing parents, which clients do not expect.
+func (c *Cache) Parent(p string) error {
+	e, err := c.Stat(path.Dir(path.Clean("/" + p)))
+	if err != nil {
+		return err
+	}
+
+	if !e.Dir {
+		return os.ErrNotExist
+	}
+
+	return nil
+}
+
+// Update adds e to the cached listing of dir or, if e is nil, removes the
+// entry with the given name from it.
+func (c *Cache) Update(dir string, name string, e *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.listings[DirPath(dir)]
+	if !ok {
+		return
+	}
+
+	if e == nil {
+		delete(l.entries, name)
+	} else {
+		l.entries[name] = e
+	}
+}
+
+// Invalidate removes the cached listings of the given directories.
+func (c *Cache) Invalidate(dirs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, dir := range dirs {
+		delete(c.listings, DirPath(dir))
+	}
+}
+
+// Forget removes the cached listings of p and all directories below it.
+func (c *Cache) Forget(p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for dir := range c.listings {
+		if strings.HasPrefix(dir, DirPath(p)) {
+			delete(c.listings, dir)
+		}
+	}
+}
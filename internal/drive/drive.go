@@ -0,0 +1,86 @@
+// Package drive implements what the servers which map the myCloud Drive as
+// file system have in common: cached directory listings, ranged reads with
+// read-ahead and moving directories.
+package drive
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// Entry represents a file or directory of a listing.
+type Entry struct {
+	Name  string    `json:"name"`
+	Dir   bool      `json:"dir"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+	CTime time.Time `json:"-"`
+	MIME  string    `json:"mime,omitempty"`
+	ETag  string    `json:"-"`
+}
+
+// Info returns the entry as os.FileInfo.
+func (e *Entry) Info() os.FileInfo {
+	return fileInfo{e}
+}
+
+// fileInfo implements os.FileInfo.
+type fileInfo struct {
+	e *Entry
+}
+
+func (fi fileInfo) Name() string       { return fi.e.Name }
+func (fi fileInfo) Size() int64        { return fi.e.Size }
+func (fi fileInfo) ModTime() time.Time { return fi.e.MTime }
+func (fi fileInfo) IsDir() bool        { return fi.e.Dir }
+func (fi fileInfo) Sys() interface{}   { return fi.e }
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.e.Dir {
+		return os.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+// DirPath returns the path of the directory p as expected by myCloud, i.e.
+// ending with a slash.
+func DirPath(p string) string {
+	return strings.TrimSuffix(p, "/") + "/"
+}
+
+// MoveDir moves the directory src with all its contents to dst. Since
+// myCloud cannot move directories, each file is moved on its own.
+func MoveDir(mc *mycloud.MyCloud, src string, dst string) error {
+	m, err := mc.Metadata(DirPath(src))
+	if err != nil {
+		return fmt.Errorf("mc.Metadata(%s): %w", DirPath(src), err)
+	}
+
+	if err := mc.CreateDirectory(DirPath(dst)); err != nil {
+		return fmt.Errorf("mc.CreateDirectory(%s): %w", DirPath(dst), err)
+	}
+
+	for _, d := range m.Directories {
+		if err := MoveDir(mc, path.Join(src, d.Name), path.Join(dst, d.Name)); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range m.Files {
+		if err := mc.Move(path.Join(src, file.Name), path.Join(dst, file.Name)); err != nil {
+			return fmt.Errorf("mc.Move(%s): %w", path.Join(src, file.Name), err)
+		}
+	}
+
+	if err := mc.Delete([]string{DirPath(src)}); err != nil {
+		return fmt.Errorf("mc.Delete(%s): %w", DirPath(src), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package drive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// Reader reads a file from myCloud at arbitrary offsets. Since clients
+// request blocks in parallel, which arrive slightly out of order, data is
+// requested in chunks of at least the read-ahead size and served from a
+// buffer.
+type Reader struct {
+	mc        *mycloud.MyCloud
+	path      string
+	size      int64
+	readAhead int64
+
+	mu     sync.Mutex
+	buf    []byte
+	bufOff int64
+}
+
+// NewReader creates a reader of the file at p with the given size,
+// requesting at least readAhead bytes at once.
+func NewReader(mc *mycloud.MyCloud, p string, size int64, readAhead int64) *Reader {
+	return &Reader{
+		mc:        mc,
+		path:      p,
+		size:      size,
+		readAhead: readAhead,
+	}
+}
+
+// ReadAt reads len(p) bytes at off.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if off < r.bufOff || end > r.bufOff+int64(len(r.buf)) {
+		if err := r.fill(off, end); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf[off-r.bufOff:end-r.bufOff])
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// fill replaces the buffer with the range [off, end) of the file, extended
+// to the read-ahead size. r.mu must be held.
+func (r *Reader) fill(off int64, end int64) error {
+	if end-off < r.readAhead {
+		end = off + r.readAhead
+	}
+
+	if end > r.size {
+		end = r.size
+	}
+
+	response, err := r.mc.OpenFile(r.path, fmt.Sprintf("bytes=%d-%d", off, end-1))
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The range was ignored, the body contains the whole file.
+		if _, err := io.CopyN(ioutil.Discard, response.Body, off); err != nil {
+			return fmt.Errorf("io.CopyN: %v", err)
+		}
+	default:
+		return &mycloud.StatusError{Code: response.StatusCode, Expected: http.StatusPartialContent}
+	}
+
+	buf := make([]byte, end-off)
+
+	if _, err := io.ReadFull(response.Body, buf); err != nil {
+		return fmt.Errorf("io.ReadFull: %v", err)
+	}
+
+	r.buf, r.bufOff = buf, off
+
+	return nil
+}
+
+// Close releases the buffer.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	r.buf = nil
+	r.mu.Unlock()
+
+	return nil
+}
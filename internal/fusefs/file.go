@@ -0,0 +1,403 @@
+//go:build linux
+// +build linux
+
+package fusefs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/virvum/scmc/internal/drive"
+)
+
+// File represents a regular file. While a file is opened for writing, its
+// content is kept in a local spool file, which is uploaded when the file is
+// flushed (closed) or synced. Uploads and moves are serialized by uploadMu,
+// so that mu is not held during requests to myCloud.
+type File struct {
+	fs *FS
+
+	uploadMu sync.Mutex
+
+	mu      sync.Mutex
+	path    string
+	size    uint64
+	mtime   time.Time
+	ctime   time.Time
+	spool   *os.File
+	writers int
+	dirty   bool
+}
+
+// pending returns true if the file is opened for writing.
+func (f *File) pending() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.spool != nil
+}
+
+// refresh updates the attributes of the file from a listing, unless the
+// file is opened for writing.
+func (f *File) refresh(e *drive.Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.spool == nil {
+		f.size, f.mtime, f.ctime = uint64(e.Size), e.MTime, e.CTime
+	}
+}
+
+// Attr returns the attributes of the file.
+func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	a.Mode = 0644
+	a.Size = f.size
+	a.Blocks = (f.size + 511) / 512
+	a.Mtime = f.mtime
+	a.Ctime = f.ctime
+	a.Uid = f.fs.uid
+	a.Gid = f.fs.gid
+	a.Valid = f.fs.o.AttrTTL
+
+	if f.fs.o.ReadOnly {
+		a.Mode = 0444
+	}
+
+	return nil
+}
+
+// Setattr truncates the file if its size is set. Other attributes are only
+// changed locally, since myCloud does not store them.
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if f.fs.o.ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	if req.Valid.Size() {
+		if _, err := f.open(true, req.Size == 0); err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		err := f.spool.Truncate(int64(req.Size))
+		if err == nil {
+			f.size, f.mtime, f.dirty = req.Size, time.Now(), true
+		}
+		f.mu.Unlock()
+
+		if err := f.release(); err != nil {
+			return err
+		}
+
+		if err != nil {
+			log.Error("truncating spool file of %s: %v", f.path, err)
+			return fuse.EIO
+		}
+	}
+
+	if req.Valid.Mtime() {
+		f.mu.Lock()
+		f.mtime = req.Mtime
+		f.mu.Unlock()
+	}
+
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// Open opens the file.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Flags.IsReadOnly() && !f.pending() {
+		// The content does not change as long as the attributes do not.
+		resp.Flags |= fuse.OpenKeepCache
+	}
+
+	return f.open(!req.Flags.IsReadOnly(), req.Flags&fuse.OpenTruncate != 0)
+}
+
+// open returns a handle of the file. Files opened for writing are
+// downloaded to a spool file first, unless they are truncated.
+func (f *File) open(write bool, truncate bool) (fs.Handle, error) {
+	if !write {
+		return &handle{file: f}, nil
+	}
+
+	if f.fs.o.ReadOnly {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.spool == nil {
+		spool, err := ioutil.TempFile(f.fs.o.SpoolDir, "scmc-*.spool")
+		if err != nil {
+			log.Error("creating spool file: %v", err)
+			return nil, fuse.EIO
+		}
+
+		if !truncate && f.size > 0 {
+			if err := f.fs.mc.GetFile(f.path, spool, ""); err != nil {
+				spool.Close()
+				os.Remove(spool.Name())
+				log.Error("mc.GetFile(%s): %v", f.path, err)
+
+				return nil, errno(err)
+			}
+		}
+
+		f.spool = spool
+	}
+
+	if truncate {
+		if err := f.spool.Truncate(0); err != nil {
+			log.Error("truncating spool file of %s: %v", f.path, err)
+			return nil, fuse.EIO
+		}
+
+		f.size, f.mtime, f.dirty = 0, time.Now(), true
+	}
+
+	f.writers++
+
+	return &handle{file: f, write: true}, nil
+}
+
+// upload uploads the spool file if it has been modified. f.uploadMu must be
+// held. Modifications made during the upload mark the file dirty again.
+func (f *File) upload() error {
+	f.mu.Lock()
+
+	if f.spool == nil || !f.dirty {
+		f.mu.Unlock()
+		return nil
+	}
+
+	spool, p, size := f.spool, f.path, int64(f.size)
+	f.dirty = false
+	f.mu.Unlock()
+
+	log.Debug("uploading %s (%d bytes)", p, size)
+
+	if err := f.fs.mc.CreateFile(p, io.NewSectionReader(spool, 0, size)); err != nil {
+		log.Error("mc.CreateFile(%s): %v", p, err)
+
+		f.mu.Lock()
+		f.dirty = true
+		f.mu.Unlock()
+
+		return errno(err)
+	}
+
+	return nil
+}
+
+// sync uploads the file if it has been modified and updates the cached
+// listing of its directory.
+func (f *File) sync() error {
+	f.uploadMu.Lock()
+	err := f.upload()
+	f.uploadMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	e := &drive.Entry{Name: path.Base(f.path), Size: int64(f.size), MTime: f.mtime, CTime: f.ctime}
+	dir := path.Dir(f.path)
+	f.mu.Unlock()
+
+	f.fs.cache.Update(dir, e.Name, e)
+
+	return nil
+}
+
+// release closes a handle opened for writing. The last one uploads the file
+// if necessary and removes the spool file.
+func (f *File) release() error {
+	err := f.sync()
+
+	f.uploadMu.Lock()
+	defer f.uploadMu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.writers--; f.writers > 0 {
+		return err
+	}
+
+	if f.dirty {
+		log.Error("discarding modifications of %s after failed upload", f.path)
+	}
+
+	f.spool.Close()
+	os.Remove(f.spool.Name())
+	f.spool, f.dirty = nil, false
+
+	return err
+}
+
+// rename uploads pending modifications and moves the file to dst.
+func (f *File) rename(dst string) error {
+	f.uploadMu.Lock()
+	defer f.uploadMu.Unlock()
+
+	if err := f.upload(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	src := f.path
+	f.mu.Unlock()
+
+	if err := f.fs.mc.Move(src, dst); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.path = dst
+	f.mu.Unlock()
+
+	f.fs.mu.Lock()
+	delete(f.fs.files, src)
+	f.fs.files[dst] = f
+	f.fs.mu.Unlock()
+
+	return nil
+}
+
+// Fsync uploads the file if it has been modified.
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return f.sync()
+}
+
+// Forget drops the node once the kernel no longer references it.
+func (f *File) Forget() {
+	f.mu.Lock()
+	p := f.path
+	f.mu.Unlock()
+
+	f.fs.forget(p, f)
+}
+
+// handle is an open file. Unless the file is opened for writing, reads are
+// served from a buffer which is filled with at least Options.ReadAhead bytes
+// per request to myCloud.
+type handle struct {
+	file  *File
+	write bool
+
+	mu     sync.Mutex
+	reader *drive.Reader
+	path   string
+	size   int64
+}
+
+// Read reads from the file.
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	f := h.file
+
+	f.mu.Lock()
+
+	if f.spool != nil {
+		defer f.mu.Unlock()
+
+		buf := make([]byte, req.Size)
+
+		n, err := f.spool.ReadAt(buf, req.Offset)
+		if err != nil && err != io.EOF {
+			log.Error("reading spool file of %s: %v", f.path, err)
+			return fuse.EIO
+		}
+
+		resp.Data = buf[:n]
+
+		return nil
+	}
+
+	p, size := f.path, int64(f.size)
+	f.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The buffer is dropped once the file has been renamed or modified.
+	if h.reader == nil || h.path != p || h.size != size {
+		h.reader, h.path, h.size = drive.NewReader(f.fs.mc, p, size, f.fs.o.ReadAhead), p, size
+	}
+
+	buf := make([]byte, req.Size)
+
+	n, err := h.reader.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		log.Error("reading %s at %d: %v", p, req.Offset, err)
+		return errno(err)
+	}
+
+	resp.Data = buf[:n]
+
+	return nil
+}
+
+// Write writes to the spool file.
+func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if !h.write {
+		return fuse.Errno(syscall.EBADF)
+	}
+
+	f := h.file
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.spool.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		log.Error("writing spool file of %s: %v", f.path, err)
+		return fuse.Errno(syscall.ENOSPC)
+	}
+
+	if end := uint64(req.Offset) + uint64(n); end > f.size {
+		f.size = end
+	}
+
+	f.mtime, f.dirty = time.Now(), true
+	resp.Size = n
+
+	return nil
+}
+
+// Flush uploads the file if it has been modified, so that errors are
+// reported by close(2).
+func (h *handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if !h.write {
+		return nil
+	}
+
+	return h.file.sync()
+}
+
+// Release closes the handle.
+func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if !h.write {
+		h.mu.Lock()
+		h.reader = nil
+		h.mu.Unlock()
+
+		return nil
+	}
+
+	return h.file.release()
+}
@@ -0,0 +1,464 @@
+//go:build linux
+// +build linux
+
+// Package fusefs implements a FUSE file system which maps the myCloud Drive
+// to a local directory.
+package fusefs
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/virvum/scmc/internal/drive"
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+var log logger.Log
+
+// Options represents options of the file system.
+type Options struct {
+	// AttrTTL is the duration for which the kernel caches attributes and
+	// directory entries, and for which directory listings are cached.
+	AttrTTL time.Duration
+	// ReadAhead is the minimum number of bytes requested from myCloud per read.
+	ReadAhead int64
+	// ReadOnly rejects all modifications.
+	ReadOnly bool
+	// SpoolDir is the directory in which files opened for writing are kept
+	// until they are uploaded (os.TempDir() if empty).
+	SpoolDir string
+}
+
+// FS represents the myCloud Drive as file system.
+type FS struct {
+	mc  *mycloud.MyCloud
+	o   Options
+	uid uint32
+	gid uint32
+
+	cache *drive.Cache
+
+	mu    sync.Mutex
+	files map[string]*File
+}
+
+// New creates a file system backed by the given myCloud session.
+func New(mc *mycloud.MyCloud, o Options, l logger.Log) *FS {
+	log = l
+
+	f := &FS{
+		mc:    mc,
+		o:     o,
+		uid:   uint32(os.Getuid()),
+		gid:   uint32(os.Getgid()),
+		cache: drive.NewCache(mc, o.AttrTTL),
+		files: make(map[string]*File),
+	}
+
+	// Files which have been created but not uploaded yet are kept.
+	f.cache.Keep = f.pending
+
+	return f
+}
+
+// Root returns the root directory of the myCloud Drive.
+func (f *FS) Root() (fs.Node, error) {
+	return &Dir{fs: f, path: "/"}, nil
+}
+
+// list returns the entries of the directory at the given path (ending with
+// a slash).
+func (f *FS) list(path string) (map[string]*drive.Entry, error) {
+	entries, err := f.cache.List(path)
+	if err != nil {
+		log.Error("mc.Metadata(%s): %v", path, err)
+		return nil, errno(err)
+	}
+
+	return entries, nil
+}
+
+// file returns the node of the file at the given path. Nodes are kept as
+// long as the kernel references them, so that all handles of a file share
+// the same state.
+func (f *FS) file(path string, e *drive.Entry) *File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, ok := f.files[path]
+	if !ok {
+		file = &File{fs: f, path: path}
+		f.files[path] = file
+	}
+
+	file.refresh(e)
+
+	return file
+}
+
+// pending returns true if the file at the given path is opened for writing.
+func (f *FS) pending(path string) bool {
+	f.mu.Lock()
+	file := f.files[path]
+	f.mu.Unlock()
+
+	return file != nil && file.pending()
+}
+
+// moveDir moves the directory src to dst (both ending with a slash). It
+// fails with EBUSY if files below src are opened for writing, since they
+// would be uploaded to their old path. Nodes of other files follow the move.
+func (f *FS) moveDir(src string, dst string) error {
+	f.mu.Lock()
+	var moved []*File
+
+	for p, file := range f.files {
+		if strings.HasPrefix(p, src) {
+			moved = append(moved, file)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, file := range moved {
+		if file.pending() {
+			return fuse.Errno(syscall.EBUSY)
+		}
+	}
+
+	if err := drive.MoveDir(f.mc, src, dst); err != nil {
+		log.Error("moving %s to %s: %v", src, dst, err)
+		return errno(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, file := range moved {
+		file.mu.Lock()
+		p := file.path
+		np := dst + strings.TrimPrefix(p, src)
+		file.path = np
+		file.mu.Unlock()
+
+		if f.files[p] == file {
+			delete(f.files, p)
+		}
+
+		f.files[np] = file
+	}
+
+	return nil
+}
+
+// forget removes the node of the file at the given path.
+func (f *FS) forget(path string, file *File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.files[path] == file && !file.pending() {
+		delete(f.files, path)
+	}
+}
+
+// Dir represents a directory.
+type Dir struct {
+	fs    *FS
+	path  string // ends with a slash
+	mtime time.Time
+	ctime time.Time
+}
+
+// Attr returns the attributes of the directory.
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	a.Mtime = d.mtime
+	a.Ctime = d.ctime
+	a.Uid = d.fs.uid
+	a.Gid = d.fs.gid
+	a.Valid = d.fs.o.AttrTTL
+
+	if d.fs.o.ReadOnly {
+		a.Mode = os.ModeDir | 0555
+	}
+
+	return nil
+}
+
+// Lookup returns the node of the given directory entry.
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	entries, err := d.fs.list(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := entries[req.Name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	resp.EntryValid = d.fs.o.AttrTTL
+
+	if e.Dir {
+		return &Dir{fs: d.fs, path: d.path + e.Name + "/", mtime: e.MTime, ctime: e.CTime}, nil
+	}
+
+	return d.fs.file(d.path+e.Name, e), nil
+}
+
+// ReadDirAll returns all entries of the directory.
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries, err := d.fs.list(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	dirents := make([]fuse.Dirent, 0, len(entries))
+
+	for _, e := range entries {
+		de := fuse.Dirent{Name: e.Name, Type: fuse.DT_File}
+
+		if e.Dir {
+			de.Type = fuse.DT_Dir
+		}
+
+		dirents = append(dirents, de)
+	}
+
+	return dirents, nil
+}
+
+// Mkdir creates a directory.
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if d.fs.o.ReadOnly {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+
+	entries, err := d.fs.list(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := entries[req.Name]; ok {
+		return nil, fuse.EEXIST
+	}
+
+	p := d.path + req.Name + "/"
+
+	if err := d.fs.mc.CreateDirectory(p); err != nil {
+		log.Error("mc.CreateDirectory(%s): %v", p, err)
+		return nil, errno(err)
+	}
+
+	now := time.Now()
+	d.fs.cache.Update(d.path, req.Name, &drive.Entry{Name: req.Name, Dir: true, MTime: now, CTime: now})
+
+	return &Dir{fs: d.fs, path: p, mtime: now, ctime: now}, nil
+}
+
+// Create creates a file and opens it for writing. The file is uploaded when
+// it is closed.
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if d.fs.o.ReadOnly {
+		return nil, nil, fuse.Errno(syscall.EROFS)
+	}
+
+	entries, err := d.fs.list(d.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	e, ok := entries[req.Name]
+
+	switch {
+	case ok && e.Dir:
+		return nil, nil, fuse.Errno(syscall.EISDIR)
+	case ok && req.Flags&fuse.OpenExclusive != 0:
+		return nil, nil, fuse.EEXIST
+	case !ok:
+		now := time.Now()
+		e = &drive.Entry{Name: req.Name, MTime: now, CTime: now}
+	}
+
+	file := d.fs.file(d.path+req.Name, e)
+
+	h, err := file.open(true, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d.fs.cache.Update(d.path, req.Name, e)
+
+	return file, h, nil
+}
+
+// Remove removes a file or an empty directory.
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if d.fs.o.ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	entries, err := d.fs.list(d.path)
+	if err != nil {
+		return err
+	}
+
+	e, ok := entries[req.Name]
+
+	switch {
+	case !ok:
+		return fuse.ENOENT
+	case req.Dir && !e.Dir:
+		return fuse.Errno(syscall.ENOTDIR)
+	case !req.Dir && e.Dir:
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	p := d.path + req.Name
+
+	if e.Dir {
+		p += "/"
+
+		// myCloud deletes directories recursively, rmdir must not.
+		children, err := d.fs.list(p)
+		if err != nil {
+			return err
+		}
+
+		if len(children) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+
+	if err := d.fs.mc.Delete([]string{p}); err != nil {
+		log.Error("mc.Delete(%s): %v", p, err)
+		return errno(err)
+	}
+
+	d.fs.cache.Update(d.path, req.Name, nil)
+
+	return nil
+}
+
+// Rename moves a file or directory.
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if d.fs.o.ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	nd, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.EIO
+	}
+
+	entries, err := d.fs.list(d.path)
+	if err != nil {
+		return err
+	}
+
+	e, ok := entries[req.OldName]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	targets, err := nd.fs.list(nd.path)
+	if err != nil {
+		return err
+	}
+
+	if e.Dir {
+		return d.renameDir(nd, req.OldName, req.NewName, e, targets[req.NewName])
+	}
+
+	var (
+		src = d.path + req.OldName
+		dst = nd.path + req.NewName
+	)
+
+	// An existing target is replaced by the move, deleting it first would
+	// lose it if the move fails.
+	if t, ok := targets[req.NewName]; ok && t.Dir {
+		return fuse.Errno(syscall.EISDIR)
+	}
+
+	if err := d.fs.file(src, e).rename(dst); err != nil {
+		log.Error("moving %s to %s: %v", src, dst, err)
+		return errno(err)
+	}
+
+	d.fs.cache.Update(d.path, req.OldName, nil)
+	d.fs.cache.Update(nd.path, req.NewName, &drive.Entry{Name: req.NewName, Size: e.Size, MTime: e.MTime, CTime: e.CTime})
+
+	return nil
+}
+
+// renameDir moves the directory with the given name to newName in nd. An
+// existing target must be an empty directory, which is replaced.
+func (d *Dir) renameDir(nd *Dir, name string, newName string, e *drive.Entry, t *drive.Entry) error {
+	var (
+		src = d.path + name + "/"
+		dst = nd.path + newName + "/"
+	)
+
+	switch {
+	case src == dst:
+		return nil
+	case strings.HasPrefix(dst, src):
+		return fuse.Errno(syscall.EINVAL)
+	case t != nil && !t.Dir:
+		return fuse.Errno(syscall.ENOTDIR)
+	case t != nil:
+		children, err := d.fs.list(dst)
+		if err != nil {
+			return err
+		}
+
+		if len(children) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+
+		if err := d.fs.mc.Delete([]string{dst}); err != nil {
+			log.Error("mc.Delete(%s): %v", dst, err)
+			return errno(err)
+		}
+	}
+
+	err := d.fs.moveDir(src, dst)
+
+	d.fs.cache.Forget(src)
+	d.fs.cache.Forget(dst)
+
+	if err != nil {
+		d.fs.cache.Invalidate(d.path, nd.path)
+		return err
+	}
+
+	d.fs.cache.Update(d.path, name, nil)
+	d.fs.cache.Update(nd.path, newName, &drive.Entry{Name: newName, Dir: true, MTime: e.MTime, CTime: e.CTime})
+
+	return nil
+}
+
+// errno maps errors returned by the myCloud API to error numbers.
+func errno(err error) error {
+	switch mycloud.StatusCode(err) {
+	case http.StatusNotFound:
+		return fuse.ENOENT
+	case http.StatusConflict:
+		return fuse.EEXIST
+	case http.StatusForbidden:
+		return fuse.EPERM
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		return fuse.Errno(syscall.ENOSPC)
+	}
+
+	return fuse.EIO
+}
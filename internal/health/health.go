@@ -0,0 +1,170 @@
+// Package health implements liveness and readiness endpoints for the servers
+// provided by scmc, probing myCloud with the configured accounts.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/virvum/scmc/internal/config"
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// Result represents the result of probing a single account.
+type Result struct {
+	Username string
+	Err      error
+	Time     time.Time
+}
+
+// Checker probes myCloud by requesting the usage of each configured account.
+// Sessions are kept between probes and results are cached for the given
+// interval, so that frequent readiness checks do not hammer myCloud.
+type Checker struct {
+	accounts []config.Account
+	interval time.Duration
+	log      logger.Log
+	options  []mycloud.Option
+	mu       sync.Mutex
+	sessions map[string]*mycloud.MyCloud
+	results  []Result
+}
+
+// New creates a checker for the given accounts. Sessions are created with
+// the given options.
+func New(accounts []config.Account, interval time.Duration, l logger.Log, options ...mycloud.Option) *Checker {
+	return &Checker{
+		accounts: accounts,
+		interval: interval,
+		log:      l,
+		options:  options,
+		sessions: make(map[string]*mycloud.MyCloud),
+	}
+}
+
+// Probe returns the results of the last probe of all accounts, probing them
+// again if the results are older than the interval.
+func (c *Checker) Probe() []Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.results) > 0 && time.Since(c.results[0].Time) < c.interval {
+		return c.results
+	}
+
+	c.results = c.probe(false)
+
+	return c.results
+}
+
+// Login logs in with all accounts and requests their usage, without reusing
+// existing sessions or cached results.
+func (c *Checker) Login() []Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.probe(true)
+}
+
+// probe probes all accounts concurrently. c.mu must be held.
+func (c *Checker) probe(fresh bool) []Result {
+	var (
+		wg       sync.WaitGroup
+		now      = time.Now()
+		results  = make([]Result, len(c.accounts))
+		sessions = make([]*mycloud.MyCloud, len(c.accounts))
+	)
+
+	// The goroutines only access their own element of sessions, c.sessions
+	// is updated once all of them are done.
+	if !fresh {
+		for i, a := range c.accounts {
+			sessions[i] = c.sessions[a.Username]
+		}
+	}
+
+	for i, a := range c.accounts {
+		wg.Add(1)
+
+		go func(i int, a config.Account) {
+			defer wg.Done()
+
+			mc := sessions[i]
+
+			err := func() error {
+				if mc == nil {
+					var err error
+
+					if mc, err = mycloud.New(a.Username, a.Password, c.log, c.options...); err != nil {
+						return fmt.Errorf("login failed: %v", err)
+					}
+				}
+
+				if _, err := mc.Usage(); err != nil {
+					mc = nil
+					return fmt.Errorf("mc.Usage: %v", err)
+				}
+
+				return nil
+			}()
+
+			sessions[i] = mc
+			results[i] = Result{a.Username, err, now}
+		}(i, a)
+	}
+
+	wg.Wait()
+
+	for i, a := range c.accounts {
+		if sessions[i] != nil {
+			c.sessions[a.Username] = sessions[i]
+		} else {
+			delete(c.sessions, a.Username)
+		}
+	}
+
+	return results
+}
+
+// Handler serves "/healthz" and "/readyz" without authentication and passes
+// all other requests to next. "/healthz" succeeds as long as the process is
+// serving requests. "/readyz" additionally probes myCloud if c is not nil
+// and fails with 503 if any account cannot be used. Since the endpoints are
+// not authenticated, the failed accounts are only logged.
+func Handler(next http.Handler, c *Checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+		case "/readyz":
+			if c == nil {
+				break
+			}
+
+			failed := false
+
+			for _, res := range c.Probe() {
+				if res.Err != nil {
+					c.log.Warn("readiness probe of %s failed: %v", res.Username, res.Err)
+					failed = true
+				}
+			}
+
+			if failed {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, "unavailable")
+
+				return
+			}
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,203 @@
+// Package listener creates listeners for the servers provided by scmc: TCP
+// sockets, Unix domain sockets and sockets passed by systemd (socket
+// activation).
+package listener
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// UnixPrefix is the prefix of addresses of Unix domain sockets.
+	UnixPrefix = "unix:"
+	// Systemd is the address which selects the socket passed by systemd.
+	Systemd = "systemd"
+
+	// First file descriptor passed by systemd, see sd_listen_fds(3).
+	listenFdsStart = 3
+)
+
+// Listen returns a listener for the given address, which is either
+// "unix:<path>" for a Unix domain socket created with the given permissions,
+// "systemd" for the socket passed by systemd or "host:port" for a TCP socket.
+func Listen(address string, mode os.FileMode) (net.Listener, error) {
+	switch {
+	case address == Systemd:
+		ls, err := SystemdListeners()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ls) != 1 {
+			for _, l := range ls {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("expected exactly one socket from systemd, got %d", len(ls))
+		}
+
+		return ls[0], nil
+	case strings.HasPrefix(address, UnixPrefix):
+		return listenUnix(strings.TrimPrefix(address, UnixPrefix), mode)
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// listenUnix creates a Unix domain socket at path, replacing a stale socket
+// left behind by a previous instance.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("os.Remove: %v", err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %v", err)
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("os.Chmod: %v", err)
+	}
+
+	return l, nil
+}
+
+// SystemdListeners returns the sockets passed by systemd via LISTEN_FDS and
+// LISTEN_PID. The environment variables are unset, so that child processes
+// do not inherit them.
+func SystemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_PID not set to %d)", os.Getpid())
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd (invalid LISTEN_FDS %q)", os.Getenv("LISTEN_FDS"))
+	}
+
+	var ls []net.Listener
+
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		// net.FileListener duplicates the descriptor, the original one is
+		// closed right away.
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+
+		l, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("net.FileListener(%d): %v", fd, err)
+		}
+
+		ls = append(ls, l)
+	}
+
+	return ls, nil
+}
+
+// IdleTracker tracks the connections of an HTTP server and signals when no
+// request has been served for the given duration.
+type IdleTracker struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	busy    func() bool
+	conns   map[net.Conn]bool
+	active  int
+	timer   *time.Timer
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewIdleTracker creates an idle tracker and starts its timer. If busy is
+// not nil and returns true when the timeout expires, the timer is restarted.
+func NewIdleTracker(timeout time.Duration, busy func() bool) *IdleTracker {
+	t := &IdleTracker{
+		timeout: timeout,
+		busy:    busy,
+		conns:   make(map[net.Conn]bool),
+		done:    make(chan struct{}),
+	}
+
+	t.timer = time.AfterFunc(timeout, t.expire)
+
+	return t
+}
+
+// ConnState is to be used as http.Server.ConnState.
+func (t *IdleTracker) ConnState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	wasActive := t.conns[c]
+
+	switch state {
+	case http.StateNew, http.StateActive:
+		t.conns[c] = true
+	case http.StateIdle:
+		t.conns[c] = false
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	}
+
+	switch isActive := t.conns[c]; {
+	case isActive && !wasActive:
+		if t.active++; t.active == 1 {
+			t.timer.Stop()
+		}
+	case !isActive && wasActive:
+		if t.active--; t.active == 0 {
+			t.timer.Reset(t.timeout)
+		}
+	}
+}
+
+func (t *IdleTracker) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.active > 0 {
+		return
+	}
+
+	if t.busy != nil && t.busy() {
+		t.timer.Reset(t.timeout)
+		return
+	}
+
+	t.once.Do(func() { close(t.done) })
+}
+
+// Done returns a channel which is closed once the server has been idle for
+// the timeout.
+func (t *IdleTracker) Done() <-chan struct{} {
+	return t.done
+}
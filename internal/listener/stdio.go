@@ -0,0 +1,101 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// stdioAddr is the address of both ends of a StdioConn.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// StdioConn is a connection over a reader and a writer, typically standard
+// input and output of a process started by a client (e.g. restic).
+type StdioConn struct {
+	r      io.Reader
+	w      io.Writer
+	once   sync.Once
+	closed chan struct{}
+}
+
+// NewStdioConn creates a connection which reads from r and writes to w.
+func NewStdioConn(r io.Reader, w io.Writer) *StdioConn {
+	return &StdioConn{
+		r:      r,
+		w:      w,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *StdioConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *StdioConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// Close closes standard output, which signals the end of the connection to
+// the client.
+func (c *StdioConn) Close() error {
+	var err error
+
+	c.once.Do(func() {
+		close(c.closed)
+
+		if f, ok := c.w.(*os.File); ok {
+			err = f.Close()
+		}
+	})
+
+	return err
+}
+
+// Closed returns a channel which is closed once the connection is closed.
+func (c *StdioConn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// LocalAddr returns a dummy address.
+func (c *StdioConn) LocalAddr() net.Addr { return stdioAddr{} }
+
+// RemoteAddr returns a dummy address.
+func (c *StdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+// SetDeadline is not supported and always returns nil.
+func (c *StdioConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline is not supported and always returns nil.
+func (c *StdioConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline is not supported and always returns nil.
+func (c *StdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// single is a listener which accepts a single connection.
+type single struct {
+	conn *StdioConn
+	once sync.Once
+}
+
+// Single returns a listener which returns c on the first call to Accept.
+// Further calls block until c is closed and return io.EOF afterwards.
+func Single(c *StdioConn) net.Listener {
+	return &single{conn: c}
+}
+
+func (l *single) Accept() (net.Conn, error) {
+	var c net.Conn
+
+	l.once.Do(func() { c = l.conn })
+
+	if c != nil {
+		return c, nil
+	}
+
+	<-l.conn.Closed()
+
+	return nil, io.EOF
+}
+
+func (l *single) Close() error   { return nil }
+func (l *single) Addr() net.Addr { return stdioAddr{} }
@@ -0,0 +1,272 @@
+// Package metrics implements a minimal set of Prometheus metric types which
+// are exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default histogram buckets for durations, in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics and exposes them over HTTP.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// New creates an empty registry.
+func New() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics of the registry in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// desc holds the name, help text and label names of a metric.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key joins label values into a map key.
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the given label values (and optional extra pairs) as
+// `{name="value",...}`.
+func (d desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", d.labels[i], quote(v)))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], quote(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Counter registers a new counter with the given label names.
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name, help, "counter", labels},
+		values: make(map[string]float64),
+	}
+
+	r.register(c)
+
+	return c
+}
+
+// Add adds v to the counter with the given label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := c.key(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] += v
+}
+
+// Inc increments the counter with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+// Histogram registers a new histogram with the given (ascending) upper
+// bucket bounds and label names.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+
+	r.register(h)
+
+	return h
+}
+
+// Observe adds a single observation to the histogram with the given label
+// values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := h.key(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+
+	keys := make([]string, 0, len(h.values))
+
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(b)), hist.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), hist.count)
+	}
+}
+
+// funcMetric is a metric without labels whose value is determined by a
+// function at the time it is exposed.
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+// GaugeFunc registers a gauge whose value is returned by fn.
+func (r *Registry) GaugeFunc(name string, help string, fn func() float64) {
+	r.register(&funcMetric{desc{name, help, "gauge", nil}, fn})
+}
+
+// CounterFunc registers a counter whose value is returned by fn.
+func (r *Registry) CounterFunc(name string, help string, fn func() float64) {
+	r.register(&funcMetric{desc{name, help, "counter", nil}, fn})
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	m.header(w)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.fn()))
+}
@@ -0,0 +1,304 @@
+package resticapi
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// CacheStats represents statistics of the local pack file cache.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Size    int64
+	MaxSize int64
+}
+
+// HitRate returns the ratio of cache hits to all cache lookups.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// cache is a size-bounded LRU cache of pack files on the local disk. Files
+// are stored in one directory per user and repository, and verified against
+// their SHA-256 name before being added.
+type cache struct {
+	dir      string
+	maxSize  int64
+	hits     uint64
+	misses   uint64
+	mu       sync.Mutex
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]bool
+}
+
+func newCache(dir string, maxSize int64) (*cache, error) {
+	c := &cache{
+		dir:      dir,
+		maxSize:  maxSize,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]bool),
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+
+	var files []os.FileInfo
+	keys := make(map[os.FileInfo]string)
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		if strings.HasSuffix(p, ".tmp") {
+			return os.Remove(p)
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, fi)
+		keys[fi] = filepath.ToSlash(rel)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filepath.Walk(%s): %v", dir, err)
+	}
+
+	// Restore the LRU order from the modification times, which are updated on every hit.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, fi := range files {
+		c.add(keys[fi], fi.Size())
+	}
+
+	log.Info("cache: %d files (%d bytes) loaded from %s", c.lru.Len(), c.size, dir)
+
+	return c, nil
+}
+
+// repoKey returns the cache directory name for the given user and repository.
+func repoKey(username string, repo string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + strings.TrimRight(repo, "/")))
+
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *cache) path(key string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(key))
+}
+
+// open returns the cached file of the given user and repository. The second
+// return value is false on a cache miss.
+func (c *cache) open(username string, repo string, name string) (*os.File, bool) {
+	key := repoKey(username, repo) + "/" + name
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		c.remove(key)
+		atomic.AddUint64(&c.misses, 1)
+
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+
+	return f, true
+}
+
+// fetch fetches a file which is not cached in the background using fill and
+// adds it to the cache once it has been verified against its name. A file is
+// only fetched once at a time.
+func (c *cache) fetch(username string, repo string, name string, fill func(io.Writer) error) {
+	key := repoKey(username, repo) + "/" + name
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok || c.inflight[key] {
+		return
+	}
+
+	c.inflight[key] = true
+
+	go func() {
+		err := c.fill(key, name, fill)
+
+		switch {
+		case err == nil:
+		case mycloud.StatusCode(err) == http.StatusNotFound:
+			log.Debug("cache: %s not found", name)
+		default:
+			log.Warn("cache: unable to cache %s: %v", name, err)
+		}
+
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+	}()
+}
+
+func (c *cache) fill(key string, name string, fill func(io.Writer) error) error {
+	p := c.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %v", err)
+	}
+
+	defer tmp.Close()
+
+	hasher := sha256.New()
+
+	if err := fill(io.MultiWriter(tmp, hasher)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != name {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("hash mismatch: %s hashes to %s", name, sum)
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("tmp.Seek: %v", err)
+	}
+
+	tmp.Close()
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("os.Rename: %v", err)
+	}
+
+	c.mu.Lock()
+	c.add(key, size)
+	c.mu.Unlock()
+
+	return nil
+}
+
+// add adds an entry and evicts the least recently used entries until the
+// cache fits into its maximum size. c.mu must be held.
+func (c *cache) add(key string, size int64) {
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+
+		if err := os.Remove(c.path(entry.key)); err != nil {
+			log.Warn("cache: os.Remove: %v", err)
+		}
+	}
+}
+
+func (c *cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		c.size -= e.Value.(*cacheEntry).size
+	}
+
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		log.Warn("cache: os.Remove: %v", err)
+	}
+}
+
+// removeFile removes a single file of the given user and repository.
+func (c *cache) removeFile(username string, repo string, name string) {
+	c.remove(repoKey(username, repo) + "/" + name)
+}
+
+// removeRepo removes all cached files of the given user and repository.
+func (c *cache) removeRepo(username string, repo string) {
+	prefix := repoKey(username, repo) + "/"
+
+	c.mu.Lock()
+	var keys []string
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, key := range keys {
+		c.remove(key)
+	}
+}
+
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: c.lru.Len(),
+		Size:    c.size,
+		MaxSize: c.maxSize,
+	}
+}
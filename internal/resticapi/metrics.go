@@ -0,0 +1,89 @@
+package resticapi
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/metrics"
+)
+
+// apiMetrics holds the metrics of the restic REST API.
+type apiMetrics struct {
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	received *metrics.CounterVec
+	sent     *metrics.CounterVec
+	logins   *metrics.CounterVec
+}
+
+// registerMetrics registers the metrics of the API. If reg is nil, the
+// metrics are recorded but not exposed.
+func (a *API) registerMetrics(reg *metrics.Registry) {
+	if reg == nil {
+		reg = metrics.New()
+	}
+
+	a.metrics = apiMetrics{
+		requests: reg.Counter("scmc_restic_requests_total", "Number of restic REST API requests.", "method", "type", "status"),
+		duration: reg.Histogram("scmc_restic_request_duration_seconds", "Duration of restic REST API requests.", metrics.DefaultBuckets, "method", "type"),
+		received: reg.Counter("scmc_restic_received_bytes_total", "Bytes received in request bodies.", "type"),
+		sent:     reg.Counter("scmc_restic_sent_bytes_total", "Bytes sent in response bodies.", "type"),
+		logins:   reg.Counter("scmc_restic_login_attempts_total", "Number of myCloud login attempts.", "result"),
+	}
+
+	reg.GaugeFunc("scmc_restic_active_sessions", "Number of authenticated myCloud sessions.", func() float64 {
+		return float64(a.sessions.Len())
+	})
+
+	if a.cache != nil {
+		reg.CounterFunc("scmc_restic_cache_hits_total", "Number of pack file cache hits.", func() float64 {
+			return float64(a.cache.stats().Hits)
+		})
+		reg.CounterFunc("scmc_restic_cache_misses_total", "Number of pack file cache misses.", func() float64 {
+			return float64(a.cache.stats().Misses)
+		})
+		reg.GaugeFunc("scmc_restic_cache_entries", "Number of files in the pack file cache.", func() float64 {
+			return float64(a.cache.stats().Entries)
+		})
+		reg.GaugeFunc("scmc_restic_cache_size_bytes", "Size of the pack file cache.", func() float64 {
+			return float64(a.cache.stats().Size)
+		})
+		reg.GaugeFunc("scmc_restic_cache_max_size_bytes", "Maximum size of the pack file cache.", func() float64 {
+			return float64(a.cache.stats().MaxSize)
+		})
+	}
+
+	if a.writeback != nil {
+		reg.GaugeFunc("scmc_restic_writeback_pending", "Number of files waiting to be uploaded.", func() float64 {
+			return float64(a.writeback.pending())
+		})
+	}
+}
+
+// observe records a finished request.
+func (m apiMetrics) observe(method string, typ string, rec *accesslog.Recorder, received uint64, d time.Duration) {
+	switch method {
+	case http.MethodHead, http.MethodGet, http.MethodPost, http.MethodDelete:
+	default:
+		method = "other"
+	}
+
+	m.requests.Inc(method, typ, strconv.Itoa(rec.Status()))
+	m.duration.Observe(d.Seconds(), method, typ)
+	m.received.Add(float64(received), typ)
+	m.sent.Add(float64(rec.Size()), typ)
+}
+
+// metricType returns the value of the "type" label of a request.
+func metricType(res resource, err error) string {
+	switch {
+	case err != nil:
+		return "invalid"
+	case res.Type == "":
+		return "repository"
+	}
+
+	return res.Type
+}
@@ -0,0 +1,150 @@
+package resticapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// Names of the subdirectories of data/ in the default layout.
+var shardName = regexp.MustCompile("^[0-9a-f]{2}$")
+
+// MigrateLayout converts the repository at the given myCloud path (e.g.
+// "/Backups/restic/host") to the given layout and returns the number of
+// moved files. Each file is copied to its new location, read back to verify
+// it against its name and removed from its old location afterwards, so an
+// interrupted migration is resumed by running it again. The repository must
+// not be accessed while it is being migrated.
+func MigrateLayout(mc *mycloud.MyCloud, repo string, to Layout, concurrency int, l logger.Log) (int, error) {
+	log = l
+
+	dataDir := strings.TrimRight(repo, "/") + "/data/"
+
+	metadata, err := mc.Metadata(dataDir)
+	if err != nil {
+		return 0, fmt.Errorf("mc.Metadata(%s): %v", dataDir, err)
+	}
+
+	var (
+		moves = make(map[string]string)
+		srcs  []string
+	)
+
+	switch to {
+	case LayoutFlat:
+		for _, d := range metadata.Directories {
+			if !shardName.MatchString(d.Name) {
+				continue
+			}
+
+			m, err := mc.Metadata(dataDir + d.Name + "/")
+			if err != nil {
+				return 0, fmt.Errorf("mc.Metadata(%s): %v", dataDir+d.Name+"/", err)
+			}
+
+			for _, f := range m.Files {
+				moves[dataDir+d.Name+"/"+f.Name] = dataDir + f.Name
+			}
+		}
+	case LayoutDefault:
+		var dirs []string
+
+		existing := make(map[string]bool)
+
+		for _, d := range metadata.Directories {
+			existing[d.Name] = true
+		}
+
+		for i := 0; i < 256; i++ {
+			if d := fmt.Sprintf("%02x", i); !existing[d] {
+				dirs = append(dirs, dataDir+d+"/")
+			}
+		}
+
+		if _, err := forEach(concurrency, dirs, mc.CreateDirectory); err != nil {
+			return 0, fmt.Errorf("mc.CreateDirectory: %v", err)
+		}
+
+		for _, f := range metadata.Files {
+			if validName.MatchString(f.Name) {
+				moves[dataDir+f.Name] = dataDir + f.Name[:2] + "/" + f.Name
+			}
+		}
+	default:
+		return 0, fmt.Errorf("invalid layout %q", to)
+	}
+
+	for src := range moves {
+		srcs = append(srcs, src)
+	}
+
+	log.Info("moving %d files in %s", len(srcs), dataDir)
+
+	failed, err := forEach(concurrency, srcs, func(src string) error {
+		log.Debug("moving %s to %s", src, moves[src])
+		return moveFile(mc, src, moves[src])
+	})
+	if err != nil {
+		return len(srcs) - len(failed), fmt.Errorf("%d files could not be moved: %v", len(failed), err)
+	}
+
+	if to == LayoutFlat && len(metadata.Directories) > 0 {
+		var dirs []string
+
+		for _, d := range metadata.Directories {
+			if shardName.MatchString(d.Name) {
+				dirs = append(dirs, dataDir+d.Name+"/")
+			}
+		}
+
+		if err := mc.Delete(dirs); err != nil {
+			return len(srcs), fmt.Errorf("mc.Delete: %v", err)
+		}
+	}
+
+	return len(srcs), nil
+}
+
+// moveFile copies a file of type data to dst, reads the copy back to verify
+// it against its name and removes src afterwards. Unlike mycloud.Move, src is
+// kept if the copy is corrupted, since it may be the only intact copy.
+func moveFile(mc *mycloud.MyCloud, src string, dst string) error {
+	var (
+		name   = dst[strings.LastIndex(dst, "/")+1:]
+		hasher = sha256.New()
+		pr, pw = io.Pipe()
+	)
+
+	go func() {
+		pw.CloseWithError(mc.GetFile(src, pw, ""))
+	}()
+
+	if err := mc.CreateFile(dst, pr); err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("mc.CreateFile(%s): %v", dst, err)
+	}
+
+	if err := mc.GetFile(dst, hasher, ""); err != nil {
+		return fmt.Errorf("mc.GetFile(%s): %v", dst, err)
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != name {
+		if err := mc.Delete([]string{dst}); err != nil {
+			log.Error("unable to remove %s after hash mismatch: %v", dst, err)
+		}
+
+		return fmt.Errorf("hash mismatch: copy of %s hashes to %s", src, sum)
+	}
+
+	if err := mc.Delete([]string{src}); err != nil {
+		return fmt.Errorf("mc.Delete(%s): %v", src, err)
+	}
+
+	return nil
+}
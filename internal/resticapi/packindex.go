@@ -0,0 +1,312 @@
+package resticapi
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// packIndex is a persistent index of the pack files (data/) of each user and
+// repository, which allows listing data/ without querying myCloud. The index
+// of a repository is built from a full listing the first time data/ is
+// listed and is kept up to date by save and delete afterwards. Hence it only
+// stays accurate as long as the repository is solely modified through this
+// server; delete the index file of a repository in order to rebuild it.
+//
+// Each repository is stored in a separate append-only file ("<key>.idx")
+// with one line per operation: "+<name> <size>" or "-<name>".
+type packIndex struct {
+	dir   string
+	mu    sync.Mutex
+	repos map[string]*repoIndex
+}
+
+type repoIndex struct {
+	loaded   bool
+	complete bool
+	entries  map[string]uint64
+	f        *os.File
+
+	// seq is the sequence number of the last add or remove. While full
+	// listings are in progress (listings > 0), these operations are kept in
+	// journal, so that populate can re-apply those a listing might miss.
+	seq      uint64
+	listings int
+	journal  []indexOp
+}
+
+// indexOp is an add or remove recorded while a listing is in progress.
+type indexOp struct {
+	seq    uint64
+	name   string
+	size   uint64
+	remove bool
+}
+
+func newPackIndex(dir string) (*packIndex, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+
+	return &packIndex{
+		dir:   dir,
+		repos: make(map[string]*repoIndex),
+	}, nil
+}
+
+func (x *packIndex) path(key string) string {
+	return filepath.Join(x.dir, key+".idx")
+}
+
+// repo returns the index of the given repository, loading it from disk on
+// first use. x.mu must be held.
+func (x *packIndex) repo(username string, repo string) *repoIndex {
+	key := repoKey(username, repo)
+
+	ri, ok := x.repos[key]
+	if !ok {
+		ri = &repoIndex{entries: make(map[string]uint64)}
+		x.repos[key] = ri
+	}
+
+	if !ri.loaded {
+		ri.loaded = true
+
+		if err := x.load(key, ri); err != nil && !os.IsNotExist(err) {
+			log.Error("index: unable to load %s, rebuilding it: %v", x.path(key), err)
+		}
+	}
+
+	return ri
+}
+
+func (x *packIndex) load(key string, ri *repoIndex) error {
+	f, err := os.Open(x.path(key))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	entries := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "+"):
+			fields := strings.Fields(line[1:])
+			if len(fields) != 2 {
+				return fmt.Errorf("invalid line: %q", line)
+			}
+
+			size, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid line: %q", line)
+			}
+
+			entries[fields[0]] = size
+		case strings.HasPrefix(line, "-"):
+			delete(entries, line[1:])
+		default:
+			return fmt.Errorf("invalid line: %q", line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for name, size := range entries {
+		ri.entries[name] = size
+	}
+
+	// Compact the file, dropping removed entries.
+	return x.write(key, ri)
+}
+
+// write replaces the index file with the current entries and keeps it open
+// for appending. x.mu must be held.
+func (x *packIndex) write(key string, ri *repoIndex) error {
+	if ri.f != nil {
+		ri.f.Close()
+		ri.f = nil
+	}
+
+	var b strings.Builder
+
+	for name, size := range ri.entries {
+		fmt.Fprintf(&b, "+%s %d\n", name, size)
+	}
+
+	if _, err := writeFileSync(x.path(key), strings.NewReader(b.String())); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(x.path(key), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %v", err)
+	}
+
+	ri.f = f
+	ri.complete = true
+
+	return nil
+}
+
+// append records a single operation in the index file. x.mu must be held.
+func (x *packIndex) append(ri *repoIndex, line string) {
+	if ri.f == nil {
+		return
+	}
+
+	_, err := ri.f.WriteString(line + "\n")
+	if err == nil {
+		err = ri.f.Sync()
+	}
+
+	if err != nil {
+		log.Error("index: unable to update %s, discarding it: %v", ri.f.Name(), err)
+
+		ri.f.Close()
+		os.Remove(ri.f.Name())
+		ri.f = nil
+		ri.complete = false
+	}
+}
+
+// list returns all pack files of the given repository. The second return
+// value is false if the index of the repository has not been built yet.
+func (x *packIndex) list(username string, repo string) ([]listEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ri := x.repo(username, repo)
+	if !ri.complete {
+		return nil, false
+	}
+
+	entries := make([]listEntry, 0, len(ri.entries))
+
+	for name, size := range ri.entries {
+		entries = append(entries, listEntry{name, size})
+	}
+
+	return entries, true
+}
+
+// begin marks the start of a full listing of the given repository and
+// returns the sequence number which is passed to populate. end must be
+// called once the listing is finished.
+func (x *packIndex) begin(username string, repo string) uint64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ri := x.repo(username, repo)
+	ri.listings++
+
+	return ri.seq
+}
+
+// end marks the end of a full listing started by begin.
+func (x *packIndex) end(username string, repo string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ri, ok := x.repos[repoKey(username, repo)]
+	if !ok || ri.listings == 0 {
+		return
+	}
+
+	if ri.listings--; ri.listings == 0 {
+		ri.journal = nil
+	}
+}
+
+// populate rebuilds the index of the given repository from a full listing,
+// dropping entries of pack files which no longer exist. Files added or
+// removed after the listing has been started (seq, see begin) are applied
+// on top of it, since the listing may or may not include them.
+func (x *packIndex) populate(username string, repo string, seq uint64, entries []listEntry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ri := x.repo(username, repo)
+	ri.entries = make(map[string]uint64, len(entries))
+
+	for _, e := range entries {
+		ri.entries[e.Name] = e.Size
+	}
+
+	for _, op := range ri.journal {
+		switch {
+		case op.seq <= seq:
+		case op.remove:
+			delete(ri.entries, op.name)
+		default:
+			ri.entries[op.name] = op.size
+		}
+	}
+
+	if err := x.write(repoKey(username, repo), ri); err != nil {
+		log.Error("index: %v", err)
+	}
+}
+
+// record assigns the next sequence number to an operation and keeps it if
+// listings are in progress. x.mu must be held.
+func (x *packIndex) record(ri *repoIndex, op indexOp) {
+	ri.seq++
+
+	if ri.listings > 0 {
+		op.seq = ri.seq
+		ri.journal = append(ri.journal, op)
+	}
+}
+
+// add records a newly saved pack file.
+func (x *packIndex) add(username string, repo string, name string, size uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ri := x.repo(username, repo)
+	ri.entries[name] = size
+
+	x.record(ri, indexOp{name: name, size: size})
+	x.append(ri, fmt.Sprintf("+%s %d", name, size))
+}
+
+// remove records a deleted pack file.
+func (x *packIndex) remove(username string, repo string, name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	ri := x.repo(username, repo)
+	delete(ri.entries, name)
+
+	x.record(ri, indexOp{name: name, remove: true})
+	x.append(ri, "-"+name)
+}
+
+// drop removes the index of the given repository.
+func (x *packIndex) drop(username string, repo string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	key := repoKey(username, repo)
+
+	if ri, ok := x.repos[key]; ok && ri.f != nil {
+		ri.f.Close()
+	}
+
+	delete(x.repos, key)
+
+	if err := os.Remove(x.path(key)); err != nil && !os.IsNotExist(err) {
+		log.Error("index: os.Remove: %v", err)
+	}
+}
@@ -1,12 +1,22 @@
 package resticapi
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/sessions"
 	"github.com/virvum/scmc/pkg/logger"
 	"github.com/virvum/scmc/pkg/mycloud"
 )
@@ -14,16 +24,124 @@ import (
 var log logger.Log
 
 // New creates a restic REST API resource.
-func New(l logger.Log) *API {
+func New(l logger.Log, o Options) (*API, error) {
 	log = l
 
-	return &API{
-		mc: make(map[string]*mycloud.MyCloud),
+	a := &API{
+		sessions:      sessions.New(l, o.MyCloudOptions...),
+		concurrency:   o.Concurrency,
+		baseDir:       strings.TrimRight(path.Clean("/"+o.BaseDir), "/"),
+		layout:        o.Layout,
+		readOnly:      o.ReadOnly,
+		readOnlyUsers: make(map[string]bool),
+		accessLog:     o.AccessLog,
 	}
+
+	for _, u := range o.ReadOnlyUsers {
+		a.readOnlyUsers[u] = true
+	}
+
+	switch a.layout {
+	case "":
+		a.layout = LayoutDefault
+	case LayoutDefault, LayoutFlat:
+	default:
+		return nil, fmt.Errorf("invalid layout %q", o.Layout)
+	}
+
+	if a.concurrency < 1 {
+		a.concurrency = 1
+	}
+
+	if o.IndexDir != "" {
+		x, err := newPackIndex(o.IndexDir)
+		if err != nil {
+			return nil, fmt.Errorf("newPackIndex: %v", err)
+		}
+
+		a.index = x
+	}
+
+	if o.WritebackDir != "" {
+		q, err := newWriteback(o.WritebackDir, o.WritebackWorkers, a.session)
+		if err != nil {
+			return nil, fmt.Errorf("newWriteback: %v", err)
+		}
+
+		a.writeback = q
+	}
+
+	if o.CacheDir != "" {
+		c, err := newCache(o.CacheDir, o.CacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("newCache: %v", err)
+		}
+
+		a.cache = c
+	}
+
+	a.registerMetrics(o.Metrics)
+
+	return a, nil
+}
+
+// CacheStats returns statistics of the local pack file cache. The second
+// return value is false if the cache is disabled.
+func (a *API) CacheStats() (CacheStats, bool) {
+	if a.cache == nil {
+		return CacheStats{}, false
+	}
+
+	return a.cache.stats(), true
+}
+
+// PendingUploads returns the number of files in the staging directory which
+// have not been uploaded yet.
+func (a *API) PendingUploads() int {
+	if a.writeback == nil {
+		return 0
+	}
+
+	return a.writeback.pending()
+}
+
+// Close waits for uploads in progress to finish. Files which have not been
+// uploaded yet remain in the staging directory and are resumed on the next start.
+func (a *API) Close() {
+	if a.writeback != nil {
+		a.writeback.close()
+
+		if n := a.writeback.pending(); n > 0 {
+			log.Info("writeback: %d uploads pending", n)
+		}
+	}
+}
+
+// session returns the myCloud session of the given user or nil if the user
+// has not been authenticated yet.
+func (a *API) session(username string) *mycloud.MyCloud {
+	return a.sessions.Session(username)
 }
 
 func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var err error
+	var (
+		start    = time.Now()
+		rec      = accesslog.NewRecorder(w)
+		body     = accesslog.NewCounter(r.Body)
+		res, err = parsePath(r.URL.Path)
+		typ      = metricType(res, err)
+
+		username, password, ok = r.BasicAuth()
+	)
+
+	w, r.Body = rec, body
+
+	defer func() {
+		d := time.Since(start)
+
+		a.metrics.observe(r.Method, typ, rec, body.Count(), d)
+		a.logRequest(r, username, res, rec, body.Count(), d, err)
+	}()
 
 	if log.Level <= logger.Debug {
 		requestDump, err := httputil.DumpRequest(r, log.Level <= logger.Trace)
@@ -39,139 +157,308 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	username, password, ok := r.BasicAuth()
-
 	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="restic"`)
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
-	if _, ok := a.mc[username]; !ok {
-		// TODO we need to block other requests here
+	// Existing sessions are only used if the password matches.
+	prev := a.sessions.Session(username)
 
-		mc, err := mycloud.New(username, password, log)
-		if err != nil {
-			log.Error("authorization failed: %s", err)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
-		}
-
-		a.mc[username] = mc
-	}
-
-	switch r.Header.Get("Accept") {
-	case mimeTypeAPIV2:
-		w.Header().Set("Content-Type", mimeTypeAPIV2)
-	default:
-		w.Header().Set("Content-Type", mimeTypeAPIV1)
+	mc, loginErr := a.sessions.Login(username, password)
+	if loginErr != nil {
+		a.metrics.logins.Inc("failure")
+		err = fmt.Errorf("authorization failed: %v", loginErr)
+		log.Error("%v", err)
+		w.Header().Set("WWW-Authenticate", `Basic realm="restic"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
 	}
 
-	fields := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if mc != prev {
+		a.metrics.logins.Inc("success")
 
-	// TODO this is dirty as fuck
-	// Convert /foo/data/d14ae05f4385855567b1260997d84a8f8eae23cbe2c1d29b7a5e1b6313283004 to /foo/data/d1/d14ae05f4385855567b1260997d84a8f8eae23cbe2c1d29b7a5e1b6313283004
-	if len(fields) == 3 && fields[len(fields)-2] == "data" {
-		r.URL.Path = fmt.Sprintf("/%s/data/%s/%s",
-			strings.Join(fields[0:len(fields)-2], "/"),
-			fields[len(fields)-1][0:2],
-			fields[len(fields)-1])
+		if a.writeback != nil {
+			a.writeback.wake()
+		}
 	}
 
-	if strings.HasSuffix(r.URL.Path, "/") {
+	switch {
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		err = fmt.Errorf("bad request to restic REST API: %v", err)
+	case (r.Method == http.MethodPost || r.Method == http.MethodDelete) && (a.readOnly || a.readOnlyUsers[username]):
+		err = a.forbidWrite(res, w)
+	case res.Type == "":
 		switch r.Method {
 		case http.MethodPost:
 			if r.URL.Query().Get("create") != "true" {
 				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 				err = fmt.Errorf("bad request to restic REST API")
 			} else {
-				err = a.create(username, w, r)
+				err = a.create(username, res, w, r)
 			}
 		case http.MethodDelete:
-			err = a.delete(username, w, r)
+			err = a.delete(username, res, w, r)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			err = fmt.Errorf("method not allowed in restic REST API")
+		}
+	case res.Name == "":
+		switch r.Method {
 		case http.MethodGet:
-			err = a.list(username, w, r)
+			err = a.list(username, res, w, r)
 		default:
-			w.WriteHeader(http.StatusNotImplemented)
-			err = fmt.Errorf("not implemented in restic REST API")
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			err = fmt.Errorf("method not allowed in restic REST API")
 		}
-	} else {
+	default:
 		switch r.Method {
 		case http.MethodHead:
-			err = a.check(username, w, r)
+			err = a.check(username, res, w, r)
 		case http.MethodGet:
-			err = a.get(username, w, r)
+			err = a.get(username, res, w, r)
 		case http.MethodPost:
-			err = a.save(username, w, r)
+			err = a.save(username, res, w, r)
 		case http.MethodDelete:
-			err = a.delete(username, w, r)
+			err = a.delete(username, res, w, r)
 		default:
-			w.WriteHeader(http.StatusNotImplemented)
-			err = fmt.Errorf("not implemented in restic REST API")
+			w.Header().Set("Allow", "HEAD, GET, POST, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			err = fmt.Errorf("method not allowed in restic REST API")
 		}
 	}
+}
 
-	var (
-		result    string
-		httpRange string
-	)
+// logRequest writes a request to the access log or, if the access log is
+// disabled, logs it as informational message.
+func (a *API) logRequest(r *http.Request, username string, res resource, rec *accesslog.Recorder, received uint64, d time.Duration, err error) {
+	if a.accessLog == nil {
+		result := "OK"
 
-	switch err {
-	case nil:
-		result = fmt.Sprintf("\033[1;32m%s\033[0m", "OK")
-	default:
-		result = fmt.Sprintf("\033[1;31merror: %s\033[0m", err)
+		if err != nil {
+			result = fmt.Sprintf("error: %s", err)
+		}
+
+		if httpRange := r.Header.Get("Range"); httpRange != "" {
+			log.Info("%s %s %s -> %d %s", r.Method, r.URL, httpRange, rec.Status(), result)
+		} else {
+			log.Info("%s %s -> %d %s", r.Method, r.URL, rec.Status(), result)
+		}
+
+		return
 	}
 
-	switch httpRange = r.Header.Get("Range"); {
-	case httpRange == "":
-	default:
-		httpRange = " " + httpRange
+	e := accesslog.NewEntry(r, username, rec, received, d, err)
+	e.Repo, e.Type = res.Repo, res.Type
+
+	a.accessLog.Log(e)
+}
+
+// forbidWrite rejects a write operation in read-only mode. Creating and
+// removing locks is rejected with an explicit hint, since restic commands
+// only work with read-only repositories if run with --no-lock.
+func (a *API) forbidWrite(res resource, w http.ResponseWriter) error {
+	if res.Type == "locks" {
+		http.Error(w, "repository is read-only, locks cannot be created or removed (run restic with --no-lock)", http.StatusForbidden)
+		return fmt.Errorf("read-only mode: lock rejected (restic must be run with --no-lock)")
 	}
 
-	log.Info("\033[1;34m%s %s\033[0m%s -> %s\n", r.Method, r.URL, httpRange, result)
+	http.Error(w, "repository is read-only", http.StatusForbidden)
+
+	return fmt.Errorf("read-only mode: write operation rejected")
 }
 
-// Creates the restic repository layout.
-func (a *API) create(username string, w http.ResponseWriter, r *http.Request) error {
-	if err := a.mc[username].CreateDirectory(r.URL.Path); err != nil {
+// Creates the restic repository layout. Existing directories are kept, so an
+// interrupted creation is resumed by creating the repository again. If the
+// repository did not exist before and its layout cannot be created
+// completely, it is removed again.
+func (a *API) create(username string, res resource, w http.ResponseWriter, r *http.Request) error {
+	var (
+		mc       = a.session(username)
+		repo     = a.remotePath(res)
+		existing = make(map[string]bool)
+		resumed  bool
+		seq      uint64
+	)
+
+	if a.index != nil {
+		seq = a.index.begin(username, a.remoteRepo(res))
+		defer a.index.end(username, a.remoteRepo(res))
+	}
+
+	if m, err := mc.Metadata(repo); err == nil {
+		resumed = true
+
+		for _, f := range m.Files {
+			if f.Name == "config" {
+				http.Error(w, "repository already exists", http.StatusConflict)
+				return fmt.Errorf("repository %s already exists", repo)
+			}
+		}
+
+		for _, d := range m.Directories {
+			existing[repo+d.Name+"/"] = true
+		}
+
+		if existing[repo+"data/"] {
+			m, err := mc.Metadata(repo + "data/")
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return fmt.Errorf("internal server error: %v", err)
+			}
+
+			for _, d := range m.Directories {
+				existing[repo+"data/"+d.Name+"/"] = true
+			}
+		}
+
+		log.Info("resuming creation of repository %s (%d directories exist)", repo, len(existing))
+	} else if err := mc.CreateDirectory(repo); err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return fmt.Errorf("internal server error: %v", err)
 	}
 
+	var dirs []string
+
 	for _, d := range validTypes {
-		if d == "config" {
-			continue
+		if d != "config" && !existing[repo+d+"/"] {
+			dirs = append(dirs, repo+d+"/")
 		}
+	}
 
-		if err := a.mc[username].CreateDirectory(fmt.Sprintf("%s%s/", r.URL.Path, d)); err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return fmt.Errorf("internal server error: %v", err)
+	failed, err := forEach(a.concurrency, dirs, mc.CreateDirectory)
+
+	if err == nil && a.layout == LayoutDefault {
+		dirs = nil
+
+		for i := 0; i < 256; i++ {
+			if p := fmt.Sprintf("%sdata/%02x/", repo, i); !existing[p] {
+				dirs = append(dirs, p)
+			}
 		}
+
+		failed, err = forEach(a.concurrency, dirs, mc.CreateDirectory)
 	}
 
-	for i := 0; i < 256; i++ {
-		if err := a.mc[username].CreateDirectory(fmt.Sprintf("%sdata/%02x/", r.URL.Path, i)); err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return fmt.Errorf("internal server error: %v", err)
+	if err != nil {
+		if !resumed {
+			derr := mc.Delete([]string{repo})
+			if derr == nil {
+				http.Error(w, "unable to create repository layout, repository removed", http.StatusInternalServerError)
+				return fmt.Errorf("unable to create repository layout, repository removed: %v", err)
+			}
+
+			log.Error("unable to remove partially created repository %s: %v", repo, derr)
 		}
+
+		msg := fmt.Sprintf("repository partially created, %d directories missing, create the repository again to resume", len(failed))
+		http.Error(w, msg, http.StatusInternalServerError)
+
+		return fmt.Errorf("%s: %v", msg, err)
+	}
+
+	if a.index != nil {
+		a.index.populate(username, a.remoteRepo(res), seq, nil)
 	}
 
 	return nil
 }
 
+// forEach calls fn for each of the given paths, running up to concurrency
+// calls concurrently. It returns the paths for which fn failed along with the
+// first error.
+func forEach(concurrency int, paths []string, fn func(string) error) ([]string, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failed   []string
+		firstErr error
+		sem      = make(chan struct{}, concurrency)
+	)
+
+	for _, p := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(p string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := fn(p); err != nil {
+				mu.Lock()
+				failed = append(failed, p)
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %v", p, err)
+				}
+				mu.Unlock()
+			}
+		}(p)
+	}
+
+	wg.Wait()
+
+	return failed, firstErr
+}
+
 // Delete a directory and all of its contents or a file.
-func (a *API) delete(username string, w http.ResponseWriter, r *http.Request) error {
-	if err := a.mc[username].Delete([]string{r.URL.Path}); err != nil {
+func (a *API) delete(username string, res resource, w http.ResponseWriter, r *http.Request) error {
+	p := a.remotePath(res)
+
+	// The index is only updated once the file is gone, otherwise it would
+	// miss pack files which still exist if the deletion fails.
+	updateIndex := func() {
+		if a.index == nil {
+			return
+		}
+
+		if res.Type == "" {
+			a.index.drop(username, a.remoteRepo(res))
+		} else if res.Type == "data" {
+			a.index.remove(username, a.remoteRepo(res), res.Name)
+		}
+	}
+
+	// An older copy of a file whose upload is cancelled may exist on myCloud,
+	// hence it is deleted in any case; it is missing if the file has never
+	// been uploaded.
+	cancelled := a.writeback != nil && a.writeback.cancel(username, p)
+
+	if err := a.session(username).Delete([]string{p}); err != nil && !(cancelled && mycloud.StatusCode(err) == http.StatusNotFound) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return fmt.Errorf("internal server error: %v", err)
 	}
 
+	updateIndex()
+
+	if a.cache != nil {
+		if res.Type == "" {
+			a.cache.removeRepo(username, a.remoteRepo(res))
+		} else if res.Type == "data" {
+			a.cache.removeFile(username, a.remoteRepo(res), res.Name)
+		}
+	}
+
 	return nil
 }
 
 // Check whether a file exists and return its size in bytes in the Content-Length header.
-func (a *API) check(username string, w http.ResponseWriter, r *http.Request) error {
-	metadata, err := a.mc[username].Metadata(r.URL.Path)
+func (a *API) check(username string, res resource, w http.ResponseWriter, r *http.Request) error {
+	p := a.remotePath(res)
+
+	if a.writeback != nil {
+		if size, ok := a.writeback.stat(username, p); ok {
+			w.Header().Add("Content-Length", fmt.Sprint(size))
+			return nil
+		}
+	}
+
+	metadata, err := a.session(username).Metadata(p)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return fmt.Errorf("not found: %v", err)
@@ -182,91 +469,392 @@ func (a *API) check(username string, w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
-// Returns the content of the given file path.
-func (a *API) get(username string, w http.ResponseWriter, r *http.Request) error {
-	// TODO w.Header().Add("Content-Type", "binary/octet-stream")
+// Returns the content of the given file path. Range requests are answered
+// with "206 Partial Content" and unsatisfiable ranges with "416 Requested
+// Range Not Satisfiable".
+func (a *API) get(username string, res resource, w http.ResponseWriter, r *http.Request) error {
+	p := a.remotePath(res)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if a.writeback != nil {
+		if f, ok := a.writeback.open(username, p); ok {
+			defer f.Close()
+
+			http.ServeContent(w, r, "", time.Time{}, f)
+
+			return nil
+		}
+	}
+
+	if a.cache != nil && res.Type == "data" {
+		if f, ok := a.cache.open(username, a.remoteRepo(res), res.Name); ok {
+			defer f.Close()
+
+			http.ServeContent(w, r, "", time.Time{}, f)
+
+			return nil
+		}
+
+		// On a miss, the request is answered by myCloud and the file is cached
+		// in the background, so that reading a range (e.g. the header of a pack
+		// file) does not wait for the whole file.
+		mc := a.session(username)
+
+		a.cache.fetch(username, a.remoteRepo(res), res.Name, func(fw io.Writer) error {
+			return mc.GetFile(p, fw, "")
+		})
+	}
+
+	response, err := a.session(username).OpenFile(p, r.Header.Get("Range"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return fmt.Errorf("internal server error: %v", err)
+	}
+
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return fmt.Errorf("not found")
+	case http.StatusRequestedRangeNotSatisfiable:
+		if cr := response.Header.Get("Content-Range"); cr != "" {
+			w.Header().Set("Content-Range", cr)
+		}
+
+		http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+		return fmt.Errorf("requested range not satisfiable")
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return fmt.Errorf("internal server error: got status code %d from myCloud", response.StatusCode)
+	}
+
+	for _, h := range []string{"Content-Length", "Content-Range"} {
+		if v := response.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+
+	w.WriteHeader(response.StatusCode)
+
+	if _, err := io.Copy(w, response.Body); err != nil {
+		return fmt.Errorf("io.Copy: %v", err)
+	}
+
+	return nil
+}
+
+// Saves the content of the request body as a file at the given path. Files
+// which are named after the SHA-256 hash of their content are spooled to a
+// temporary file and only uploaded if the hash matches the name, so that an
+// existing file is not replaced by corrupted content.
+func (a *API) save(username string, res resource, w http.ResponseWriter, r *http.Request) error {
+	p := a.remotePath(res)
 
-	httpRange := r.Header.Get("Range")
+	if !contains(hashedTypes, res.Type) {
+		if err := a.session(username).CreateFile(p, r.Body); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return fmt.Errorf("internal server error: %v", err)
+		}
 
-	if err := a.mc[username].GetFile(r.URL.Path, w, httpRange); err != nil {
-		return fmt.Errorf("a.mc.GetFile: %v", err)
+		return nil
+	}
+
+	if a.writeback != nil {
+		return a.saveWriteback(username, res, w, r)
+	}
+
+	spool, err := ioutil.TempFile("", "scmc-*.spool")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return fmt.Errorf("internal server error: ioutil.TempFile: %v", err)
+	}
+
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	hasher := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(spool, hasher), r.Body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return fmt.Errorf("internal server error: spooling request body: %v", err)
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != res.Name {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return fmt.Errorf("hash mismatch: content of %s hashes to %s", p, sum)
+	}
+
+	if err := a.session(username).CreateFile(p, io.NewSectionReader(spool, 0, size)); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return fmt.Errorf("internal server error: %v", err)
+	}
+
+	if a.index != nil && res.Type == "data" {
+		a.index.add(username, a.remoteRepo(res), res.Name, uint64(size))
 	}
 
 	return nil
 }
 
-// Saves the content of the request body as a file at the given path.
-func (a *API) save(username string, w http.ResponseWriter, r *http.Request) error {
-	if err := a.mc[username].CreateFile(r.URL.Path, r.Body); err != nil {
+// saveWriteback spools the request body to the staging directory of the
+// write-back queue and acknowledges the request once it has been verified
+// and written to disk. The file is uploaded to myCloud asynchronously.
+func (a *API) saveWriteback(username string, res resource, w http.ResponseWriter, r *http.Request) error {
+	sf, err := a.writeback.spool(r.Body)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return fmt.Errorf("internal server error: %v", err)
 	}
 
+	if sf.sum != res.Name {
+		a.writeback.discard(sf)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return fmt.Errorf("hash mismatch: content of %s hashes to %s", r.URL.Path, sf.sum)
+	}
+
+	if err := a.writeback.enqueue(username, a.remotePath(res), sf); err != nil {
+		a.writeback.discard(sf)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return fmt.Errorf("internal server error: %v", err)
+	}
+
+	if a.index != nil && res.Type == "data" {
+		a.index.add(username, a.remoteRepo(res), res.Name, uint64(sf.size))
+	}
+
 	return nil
 }
 
-// Returns a JSON array containing the names of all files stored at the given path.
-func (a *API) list(username string, w http.ResponseWriter, r *http.Request) error {
-	metadata, err := a.mc[username].Metadata(r.URL.Path)
+// Returns a JSON array containing the names of all files stored at the given
+// path. With the default layout, the subdirectories of data/ are listed
+// concurrently and the response is streamed while they are being listed.
+func (a *API) list(username string, res resource, w http.ResponseWriter, r *http.Request) error {
+	v2 := strings.Contains(r.Header.Get("Accept"), mimeTypeAPIV2)
+
+	if v2 {
+		w.Header().Set("Content-Type", mimeTypeAPIV2)
+	} else {
+		w.Header().Set("Content-Type", mimeTypeAPIV1)
+	}
+
+	var (
+		lw     = newListWriter(w, v2)
+		dir    = a.remotePath(res)
+		isData = res.Type == "data"
+		// With the flat layout, data/ is listed like any other directory.
+		sharded = isData && a.layout == LayoutDefault
+	)
+
+	if isData && a.index != nil {
+		if entries, ok := a.index.list(username, a.remoteRepo(res)); ok {
+			if a.writeback != nil {
+				lw.write(a.writeback.list(username, dir))
+			}
+
+			lw.write(entries)
+
+			return lw.close()
+		}
+	}
+
+	var seq uint64
+
+	if isData && a.index != nil {
+		seq = a.index.begin(username, a.remoteRepo(res))
+		defer a.index.end(username, a.remoteRepo(res))
+	}
+
+	metadata, err := a.session(username).Metadata(dir)
 	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return fmt.Errorf("not found: %v", err)
 	}
 
-	var response []interface{}
+	var pending []listEntry
 
-	// TODO dirty dirty dirty
-	// TODO If /foo/data/ is requested, list all blobs
+	if a.writeback != nil {
+		pending = a.writeback.list(username, dir)
+		lw.write(pending)
+	}
 
-	if strings.HasSuffix(strings.Trim(r.URL.Path, "/"), "/data") {
-		for _, d := range metadata.Directories {
-			m, err := a.mc[username].Metadata(strings.TrimRight(r.URL.Path, "/") + "/" + d.Name + "/")
-			if err != nil {
-				return fmt.Errorf("not found: %v", err)
-			}
+	var entries []listEntry
 
-			switch r.Header.Get("Accept") {
-			case mimeTypeAPIV2:
-				for _, f := range m.Files {
-					response = append(response, struct {
-						Name string `json:"name"`
-						Size uint64 `json:"size"`
-					}{
-						f.Name,
-						f.Length,
-					})
-				}
-			default:
-				for _, f := range m.Files {
-					response = append(response, f.Name)
-				}
+	if sharded {
+		entries, err = a.listData(username, dir, metadata, lw)
+		if err != nil {
+			if !lw.started {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
+
+			// Otherwise the response has already been started, so the status code
+			// cannot be changed anymore; the JSON array is left incomplete instead.
+			return err
 		}
 	} else {
-		switch r.Header.Get("Accept") {
-		case mimeTypeAPIV2:
-			for _, f := range metadata.Files {
-				response = append(response, struct {
-					Name string `json:"name"`
-					Size uint64 `json:"size"`
-				}{
-					f.Name,
-					f.Length,
-				})
+		for _, f := range metadata.Files {
+			entries = append(entries, listEntry{f.Name, f.Length})
+		}
+
+		lw.write(entries)
+	}
+
+	if isData && a.index != nil {
+		// Pending uploads have been added to the index already.
+		a.index.populate(username, a.remoteRepo(res), seq, append(entries, pending...))
+	}
+
+	return lw.close()
+}
+
+// listData lists the subdirectories of data/ concurrently, writing their
+// entries to lw as they arrive, and returns all entries.
+func (a *API) listData(username string, dir string, metadata *mycloud.MetadataResponse, lw *listWriter) ([]listEntry, error) {
+	type result struct {
+		entries []listEntry
+		err     error
+	}
+
+	var (
+		all     []listEntry
+		mc      = a.session(username)
+		results = make(chan result, len(metadata.Directories))
+		sem     = make(chan struct{}, a.concurrency)
+		stop    = make(chan struct{})
+	)
+
+	defer close(stop)
+
+	for _, d := range metadata.Directories {
+		go func(p string) {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				results <- result{err: fmt.Errorf("listing aborted")}
+				return
 			}
-		default:
-			for _, f := range metadata.Files {
-				response = append(response, f.Name)
+
+			defer func() { <-sem }()
+
+			m, err := mc.Metadata(p)
+			if err != nil {
+				results <- result{err: fmt.Errorf("mc.Metadata(%s): %v", p, err)}
+				return
 			}
+
+			var entries []listEntry
+
+			for _, f := range m.Files {
+				entries = append(entries, listEntry{f.Name, f.Length})
+			}
+
+			results <- result{entries: entries}
+		}(dir + d.Name + "/")
+	}
+
+	for range metadata.Directories {
+		res := <-results
+		if res.err != nil {
+			return nil, res.err
 		}
+
+		lw.write(res.entries)
+		all = append(all, res.entries...)
 	}
 
-	responseJSON, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return fmt.Errorf("json.Marshal: %v", err)
+	return all, nil
+}
+
+// listWriter streams a JSON array of list entries, omitting duplicates.
+type listWriter struct {
+	w       http.ResponseWriter
+	v2      bool
+	started bool
+	seen    map[string]bool
+	err     error
+}
+
+func newListWriter(w http.ResponseWriter, v2 bool) *listWriter {
+	return &listWriter{
+		w:    w,
+		v2:   v2,
+		seen: make(map[string]bool),
 	}
+}
 
-	w.Write(responseJSON)
+func (lw *listWriter) write(entries []listEntry) {
+	var b strings.Builder
 
-	return nil
+	for _, e := range entries {
+		if lw.seen[e.Name] {
+			continue
+		}
+
+		lw.seen[e.Name] = true
+
+		var (
+			data []byte
+			err  error
+		)
+
+		if lw.v2 {
+			data, err = json.Marshal(e)
+		} else {
+			data, err = json.Marshal(e.Name)
+		}
+
+		if err != nil {
+			// Marshalling strings and integers cannot fail.
+			panic(err)
+		}
+
+		if lw.started {
+			b.WriteString(",")
+		} else {
+			b.WriteString("[")
+			lw.started = true
+		}
+
+		b.Write(data)
+	}
+
+	if b.Len() == 0 || lw.err != nil {
+		return
+	}
+
+	_, lw.err = lw.w.Write([]byte(b.String()))
+
+	if f, ok := lw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close terminates the JSON array and returns the first write error, if any.
+func (lw *listWriter) close() error {
+	if lw.err != nil {
+		return lw.err
+	}
+
+	if lw.started {
+		_, lw.err = lw.w.Write([]byte("]"))
+	} else {
+		_, lw.err = lw.w.Write([]byte("[]"))
+	}
+
+	return lw.err
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,88 @@
+package resticapi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Names of all files except the configuration are hex-encoded SHA-256 hashes.
+var validName = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// resource represents the target of a request: a repository, the directory
+// of all files of a given type or a single file.
+type resource struct {
+	Repo string // repository path without trailing slash, e.g. "/hosts/web01/repo"
+	Type string // file type, empty for the repository itself
+	Name string // file name, empty for repositories and directories
+}
+
+// isDirType returns true if t is a file type stored in a directory.
+func isDirType(t string) bool {
+	return t != "config" && contains(validTypes, t)
+}
+
+// parsePath parses a request path of the form "{repo}/", "{repo}/{type}/",
+// "{repo}/config" or "{repo}/{type}/{name}", where {repo} consists of any
+// number of path segments.
+func parsePath(p string) (resource, error) {
+	var res resource
+
+	if !strings.HasPrefix(p, "/") {
+		return res, fmt.Errorf("path must start with a slash")
+	}
+
+	fields := strings.Split(strings.Trim(p, "/"), "/")
+	n := len(fields)
+
+	for _, f := range fields {
+		if f == "" || f == "." || f == ".." {
+			return res, fmt.Errorf("invalid path segment %q", f)
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(p, "/") && n >= 2 && isDirType(fields[n-1]):
+		res.Repo, res.Type = "/"+strings.Join(fields[:n-1], "/"), fields[n-1]
+	case strings.HasSuffix(p, "/"):
+		res.Repo = "/" + strings.Join(fields, "/")
+	case n >= 2 && fields[n-1] == "config":
+		res.Repo, res.Type, res.Name = "/"+strings.Join(fields[:n-1], "/"), "config", "config"
+	case n >= 3 && isDirType(fields[n-2]):
+		if !validName.MatchString(fields[n-1]) {
+			return res, fmt.Errorf("invalid file name %q", fields[n-1])
+		}
+
+		res.Repo, res.Type, res.Name = "/"+strings.Join(fields[:n-2], "/"), fields[n-2], fields[n-1]
+	default:
+		return res, fmt.Errorf("invalid path %q", p)
+	}
+
+	return res, nil
+}
+
+// remoteRepo returns the myCloud path of the repository of the given
+// resource, without trailing slash.
+func (a *API) remoteRepo(res resource) string {
+	return a.baseDir + res.Repo
+}
+
+// remotePath returns the myCloud path of the given resource. Directory paths
+// end with a slash. With the default layout, files of type data are stored
+// in subdirectories named after the first two characters of their name.
+func (a *API) remotePath(res resource) string {
+	repo := a.remoteRepo(res)
+
+	switch {
+	case res.Type == "":
+		return repo + "/"
+	case res.Name == "":
+		return repo + "/" + res.Type + "/"
+	case res.Type == "config":
+		return repo + "/config"
+	case res.Type == "data" && a.layout == LayoutDefault:
+		return fmt.Sprintf("%s/data/%s/%s", repo, res.Name[:2], res.Name)
+	}
+
+	return repo + "/" + res.Type + "/" + res.Name
+}
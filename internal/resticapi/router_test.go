@@ -0,0 +1,92 @@
+package resticapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/virvum/scmc/pkg/logger"
+)
+
+var testName = strings.Repeat("0123456789abcdef", 4)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		res  resource
+		err  bool
+	}{
+		{path: "/repo/", res: resource{Repo: "/repo"}},
+		{path: "/host/repo/", res: resource{Repo: "/host/repo"}},
+		{path: "/repo/config", res: resource{Repo: "/repo", Type: "config", Name: "config"}},
+		{path: "/host/repo/config", res: resource{Repo: "/host/repo", Type: "config", Name: "config"}},
+		{path: "/repo/data/", res: resource{Repo: "/repo", Type: "data"}},
+		{path: "/repo/keys/", res: resource{Repo: "/repo", Type: "keys"}},
+		{path: "/host/repo/snapshots/", res: resource{Repo: "/host/repo", Type: "snapshots"}},
+		{path: "/repo/data/" + testName, res: resource{Repo: "/repo", Type: "data", Name: testName}},
+		{path: "/host/repo/locks/" + testName, res: resource{Repo: "/host/repo", Type: "locks", Name: testName}},
+
+		// Directories are repositories unless they are a type within one.
+		{path: "/data/", res: resource{Repo: "/data"}},
+		{path: "/config/", res: resource{Repo: "/config"}},
+		{path: "/repo/config/", res: resource{Repo: "/repo/config"}},
+		{path: "/repo/data/" + testName + "/", res: resource{Repo: "/repo/data/" + testName}},
+
+		{path: "", err: true},
+		{path: "/", err: true},
+		{path: "repo/", err: true},
+		{path: "/repo", err: true},
+		{path: "/config", err: true},
+		{path: "/repo/data", err: true},
+		{path: "/repo//data/", err: true},
+		{path: "/repo/./data/", err: true},
+		{path: "/repo/../data/", err: true},
+		{path: "/../repo/config", err: true},
+		{path: "/repo/data/" + strings.ToUpper(testName), err: true},
+		{path: "/repo/data/" + testName[1:], err: true},
+		{path: "/repo/other/" + testName, err: true},
+	}
+
+	for _, test := range tests {
+		res, err := parsePath(test.path)
+
+		if (err != nil) != test.err {
+			t.Errorf("parsePath(%q): unexpected error %v", test.path, err)
+			continue
+		}
+
+		if err == nil && res != test.res {
+			t.Errorf("parsePath(%q) = %+v, expected %+v", test.path, res, test.res)
+		}
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	tests := []struct {
+		layout Layout
+		path   string
+		remote string
+	}{
+		{LayoutDefault, "/repo/", "/Backups/restic/repo/"},
+		{LayoutDefault, "/repo/config", "/Backups/restic/repo/config"},
+		{LayoutDefault, "/repo/data/", "/Backups/restic/repo/data/"},
+		{LayoutDefault, "/repo/data/" + testName, "/Backups/restic/repo/data/01/" + testName},
+		{LayoutDefault, "/repo/keys/" + testName, "/Backups/restic/repo/keys/" + testName},
+		{LayoutFlat, "/repo/data/" + testName, "/Backups/restic/repo/data/" + testName},
+	}
+
+	for _, test := range tests {
+		a, err := New(logger.New(logger.Error, false, ""), Options{BaseDir: "/Backups/restic/", Layout: test.layout})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := parsePath(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if remote := a.remotePath(res); remote != test.remote {
+			t.Errorf("%s: remotePath(%q) = %q, expected %q", test.layout, test.path, remote, test.remote)
+		}
+	}
+}
@@ -1,15 +1,84 @@
 package resticapi
 
-import "github.com/virvum/scmc/pkg/mycloud"
+import (
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/metrics"
+	"github.com/virvum/scmc/internal/sessions"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
 
 var validTypes = []string{"data", "index", "keys", "locks", "snapshots", "config"}
 
+// Types of files which are named after the SHA-256 hash of their content.
+var hashedTypes = []string{"data", "index", "keys", "snapshots"}
+
+// Layout represents the directory layout of repositories on myCloud.
+type Layout string
+
+// Repository layouts.
+const (
+	// LayoutDefault stores files of type data in 256 subdirectories of data/,
+	// named after the first two characters of the file names.
+	LayoutDefault Layout = "default"
+	// LayoutFlat stores all files of type data directly in data/.
+	LayoutFlat Layout = "flat"
+)
+
+// Layouts contains available layouts as strings.
+var Layouts = []string{string(LayoutDefault), string(LayoutFlat)}
+
 const (
 	mimeTypeAPIV1 = "application/vnd.x.restic.rest.v1"
 	mimeTypeAPIV2 = "application/vnd.x.restic.rest.v2"
 )
 
+// Options represents options for the restic REST API.
+type Options struct {
+	// BaseDir is the myCloud directory in which repositories are stored.
+	BaseDir string
+	// Layout is the directory layout of repositories (LayoutDefault if empty).
+	Layout Layout
+	// CacheDir enables the local pack file cache if not empty.
+	CacheDir string
+	// CacheSize is the maximum size of the local pack file cache in bytes.
+	CacheSize int64
+	// WritebackDir enables asynchronous uploads via the given staging directory if not empty.
+	WritebackDir string
+	// WritebackWorkers is the number of concurrent uploads of the write-back queue.
+	WritebackWorkers int
+	// Concurrency is the maximum number of concurrent requests to myCloud when listing data/ or creating a repository.
+	Concurrency int
+	// IndexDir enables the persistent index of pack files if not empty.
+	IndexDir string
+	// ReadOnly rejects all write operations of all users.
+	ReadOnly bool
+	// ReadOnlyUsers rejects all write operations of the given users.
+	ReadOnlyUsers []string
+	// Metrics exposes the metrics of the API if not nil.
+	Metrics *metrics.Registry
+	// AccessLog receives an entry for each request if not nil.
+	AccessLog *accesslog.Logger
+	// MyCloudOptions are the options of the myCloud sessions of all users.
+	MyCloudOptions []mycloud.Option
+}
+
 // API represents an API object.
 type API struct {
-	mc map[string]*mycloud.MyCloud
+	sessions      *sessions.Pool
+	cache         *cache
+	writeback     *writeback
+	index         *packIndex
+	concurrency   int
+	baseDir       string
+	layout        Layout
+	readOnly      bool
+	readOnlyUsers map[string]bool
+	metrics       apiMetrics
+	accessLog     *accesslog.Logger
+}
+
+// listEntry represents a file returned by the list operation (version 2 format).
+type listEntry struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
 }
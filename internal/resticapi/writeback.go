@@ -0,0 +1,496 @@
+package resticapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"github.com/google/uuid"
+)
+
+const (
+	writebackRetryMin = 5 * time.Second
+	writebackRetryMax = 5 * time.Minute
+)
+
+// writebackJob represents a file which has been spooled to the staging
+// directory and not yet been uploaded to myCloud.
+type writebackJob struct {
+	ID       string
+	Username string
+	Path     string
+	Size     int64
+	Created  time.Time
+
+	uploading bool
+	failures  int
+	notBefore time.Time
+}
+
+// spoolFile represents a file written to the staging directory, which has
+// not been queued yet.
+type spoolFile struct {
+	id   string
+	size int64
+	sum  string
+}
+
+// writeback is a durable upload queue. Incoming files are written to a local
+// staging directory and uploaded to myCloud by a pool of workers. Each
+// queued file consists of a data file ("<id>.data") and a metadata file
+// ("<id>.json"), the latter being written last, so that a file is only
+// resumed after a restart if it has been spooled completely.
+//
+// Files can only be uploaded while a session of their owner exists, so after
+// a restart, pending files of a user are resumed as soon as that user
+// authenticates again.
+type writeback struct {
+	dir     string
+	session func(string) *mycloud.MyCloud
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*writebackJob
+	jobs    map[string]*writebackJob
+	closed  bool
+	wg      sync.WaitGroup
+	done    chan struct{}
+}
+
+func newWriteback(dir string, workers int, session func(string) *mycloud.MyCloud) (*writeback, error) {
+	q := &writeback{
+		dir:     dir,
+		session: session,
+		jobs:    make(map[string]*writebackJob),
+		done:    make(chan struct{}),
+	}
+
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(%s): %v", dir, err)
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+
+	// Periodically wake up the workers in order to retry failed uploads.
+	go func() {
+		t := time.NewTicker(writebackRetryMin)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				q.cond.Broadcast()
+			case <-q.done:
+				return
+			}
+		}
+	}()
+
+	return q, nil
+}
+
+func writebackKey(username string, p string) string {
+	return username + "\x00" + p
+}
+
+// load resumes the queue from the staging directory.
+func (q *writeback) load() error {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadDir(%s): %v", q.dir, err)
+	}
+
+	queued := make(map[string]bool)
+
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		fn := filepath.Join(q.dir, e.Name())
+
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return fmt.Errorf("ioutil.ReadFile(%s): %v", fn, err)
+		}
+
+		var job writebackJob
+
+		if err := json.Unmarshal(data, &job); err != nil {
+			log.Error("writeback: discarding invalid metadata file %s: %v", fn, err)
+			os.Remove(fn)
+			continue
+		}
+
+		if _, err := os.Stat(q.dataPath(job.ID)); err != nil {
+			log.Error("writeback: discarding %s of user %s: %v", job.Path, job.Username, err)
+			os.Remove(fn)
+			continue
+		}
+
+		q.jobs[writebackKey(job.Username, job.Path)] = &job
+		q.queue = append(q.queue, &job)
+		queued[job.ID] = true
+	}
+
+	// Remove incompletely spooled files.
+	for _, e := range entries {
+		name := e.Name()
+
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+		case strings.HasSuffix(name, ".data") && !queued[strings.TrimSuffix(name, ".data")]:
+		default:
+			continue
+		}
+
+		os.Remove(filepath.Join(q.dir, name))
+	}
+
+	sort.Slice(q.queue, func(i, j int) bool {
+		return q.queue[i].Created.Before(q.queue[j].Created)
+	})
+
+	if len(q.queue) > 0 {
+		log.Info("writeback: resuming %d pending uploads", len(q.queue))
+	}
+
+	return nil
+}
+
+func (q *writeback) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".data")
+}
+
+func (q *writeback) metadataPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// spool writes the content of r to the staging directory.
+func (q *writeback) spool(r io.Reader) (*spoolFile, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("uuid.NewRandom: %v", err)
+	}
+
+	sf := &spoolFile{id: id.String()}
+	hasher := sha256.New()
+
+	if sf.size, err = writeFileSync(q.dataPath(sf.id), io.TeeReader(r, hasher)); err != nil {
+		return nil, err
+	}
+
+	sf.sum = hex.EncodeToString(hasher.Sum(nil))
+
+	return sf, nil
+}
+
+// discard removes a spooled file which will not be queued.
+func (q *writeback) discard(sf *spoolFile) {
+	os.Remove(q.dataPath(sf.id))
+}
+
+// enqueue queues a spooled file for being uploaded to the given path.
+func (q *writeback) enqueue(username string, p string, sf *spoolFile) error {
+	job := &writebackJob{
+		ID:       sf.id,
+		Username: username,
+		Path:     p,
+		Size:     sf.size,
+		Created:  time.Now(),
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+
+	if _, err := writeFileSync(q.metadataPath(job.ID), strings.NewReader(string(data))); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if old, ok := q.jobs[writebackKey(username, p)]; ok && !old.uploading {
+		q.removeJob(old)
+	}
+
+	q.jobs[writebackKey(username, p)] = job
+	q.queue = append(q.queue, job)
+	q.cond.Broadcast()
+
+	return nil
+}
+
+// writeFileSync atomically writes the content of r to the file fn.
+func writeFileSync(fn string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(fn+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("os.OpenFile: %v", err)
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(fn+".tmp", fn)
+	}
+
+	if err != nil {
+		os.Remove(fn + ".tmp")
+		return 0, fmt.Errorf("writing %s: %v", fn, err)
+	}
+
+	if d, err := os.Open(filepath.Dir(fn)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return n, nil
+}
+
+// removeJob removes a job from the queue and the staging directory. q.mu must be held.
+func (q *writeback) removeJob(job *writebackJob) {
+	key := writebackKey(job.Username, job.Path)
+
+	if q.jobs[key] == job {
+		delete(q.jobs, key)
+	}
+
+	for i, j := range q.queue {
+		if j == job {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			break
+		}
+	}
+
+	// The metadata file is removed first, so that a crash never leaves a
+	// metadata file without its data file behind.
+	os.Remove(q.metadataPath(job.ID))
+	os.Remove(q.dataPath(job.ID))
+}
+
+// open returns the spooled file for the given user and path, if pending.
+func (q *writeback) open(username string, p string) (*os.File, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[writebackKey(username, p)]
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(q.dataPath(job.ID))
+	if err != nil {
+		return nil, false
+	}
+
+	return f, true
+}
+
+// stat returns the size of the spooled file for the given user and path, if pending.
+func (q *writeback) stat(username string, p string) (int64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[writebackKey(username, p)]
+	if !ok {
+		return 0, false
+	}
+
+	return job.Size, true
+}
+
+// list returns all pending files of the given user below the given directory.
+func (q *writeback) list(username string, dir string) []listEntry {
+	var entries []listEntry
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.queue {
+		if job.Username == username && strings.HasPrefix(job.Path, dir) {
+			entries = append(entries, listEntry{
+				Name: job.Path[strings.LastIndex(job.Path, "/")+1:],
+				Size: uint64(job.Size),
+			})
+		}
+	}
+
+	return entries
+}
+
+// cancel removes all pending files of the given user whose path equals p
+// or, if p ends with a slash, is located below p. Uploads in progress are
+// waited for. It returns true if a file was removed before being uploaded.
+func (q *writeback) cancel(username string, p string) bool {
+	removed := false
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		var uploading bool
+
+		for _, job := range append([]*writebackJob(nil), q.queue...) {
+			if job.Username != username || !(job.Path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(job.Path, p)) {
+				continue
+			}
+
+			if job.uploading {
+				uploading = true
+				continue
+			}
+
+			q.removeJob(job)
+			removed = true
+		}
+
+		if !uploading {
+			return removed
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// wake wakes up idle workers, e.g. because a new session became available.
+func (q *writeback) wake() {
+	q.cond.Broadcast()
+}
+
+// next returns the next job which can be uploaded along with the session of
+// its owner. q.mu must be held.
+func (q *writeback) next() (*writebackJob, *mycloud.MyCloud) {
+	now := time.Now()
+
+	for _, job := range q.queue {
+		if job.uploading || now.Before(job.notBefore) {
+			continue
+		}
+
+		if mc := q.session(job.Username); mc != nil {
+			return job, mc
+		}
+	}
+
+	return nil, nil
+}
+
+func (q *writeback) worker() {
+	defer q.wg.Done()
+
+	for {
+		q.mu.Lock()
+
+		var (
+			job *writebackJob
+			mc  *mycloud.MyCloud
+		)
+
+		for {
+			if q.closed {
+				q.mu.Unlock()
+				return
+			}
+
+			if job, mc = q.next(); job != nil {
+				break
+			}
+
+			q.cond.Wait()
+		}
+
+		job.uploading = true
+		q.mu.Unlock()
+
+		err := q.upload(mc, job)
+
+		q.mu.Lock()
+		job.uploading = false
+
+		if err != nil {
+			job.failures++
+
+			backoff := writebackRetryMin << uint(job.failures-1)
+			if backoff > writebackRetryMax || backoff <= 0 {
+				backoff = writebackRetryMax
+			}
+
+			job.notBefore = time.Now().Add(backoff)
+
+			log.Error("writeback: upload of %s failed (attempt %d, retrying in %v): %v", job.Path, job.failures, backoff, err)
+		} else {
+			log.Debug("writeback: uploaded %s", job.Path)
+			q.removeJob(job)
+		}
+
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+func (q *writeback) upload(mc *mycloud.MyCloud, job *writebackJob) error {
+	f, err := os.Open(q.dataPath(job.ID))
+	if err != nil {
+		return fmt.Errorf("os.Open: %v", err)
+	}
+
+	defer f.Close()
+
+	if err := mc.CreateFile(job.Path, f); err != nil {
+		return fmt.Errorf("mc.CreateFile: %v", err)
+	}
+
+	return nil
+}
+
+// pending returns the number of files which have not been uploaded yet.
+func (q *writeback) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.queue)
+}
+
+// close stops the workers after the uploads in progress have finished.
+// Pending files remain in the staging directory.
+func (q *writeback) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	close(q.done)
+	q.wg.Wait()
+}
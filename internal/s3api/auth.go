@@ -0,0 +1,475 @@
+package s3api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm      = "AWS4-HMAC-SHA256"
+	amzDateFormat  = "20060102T150405Z"
+	unsignedHash   = "UNSIGNED-PAYLOAD"
+	streamingHash  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	maxSkew        = 15 * time.Minute
+	maxExpires     = 7 * 24 * time.Hour
+	maxChunkSize   = 16 << 20
+	emptySHA256Hex = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// now returns the current time, to which the dates of signatures are
+// compared. Tests replace it to verify signatures of fixed dates.
+var now = time.Now
+
+// signature holds the parsed AWS Signature Version 4 of a request.
+type signature struct {
+	accessKeyID   string
+	date          time.Time
+	scope         string
+	signedHeaders []string
+	signature     string
+	payloadHash   string
+	presigned     bool
+}
+
+// authenticate verifies the signature of r (either in the Authorization
+// header or in the query string of a presigned URL) and returns the
+// credentials of the signing key. The request body is replaced by a reader
+// which verifies the payload as it is read.
+func (a *API) authenticate(r *http.Request) (*Credentials, *payload, error) {
+	var (
+		sig *signature
+		err error
+	)
+
+	switch auth := r.Header.Get("Authorization"); {
+	case strings.HasPrefix(auth, algorithm+" "):
+		sig, err = parseAuthorization(r, auth)
+	case strings.HasPrefix(auth, "AWS "):
+		return nil, nil, errSignatureV2
+	case r.URL.Query().Get("X-Amz-Algorithm") == algorithm:
+		sig, err = parsePresigned(r)
+	case r.URL.Query().Get("Signature") != "":
+		return nil, nil, errSignatureV2
+	default:
+		return nil, nil, errAccessDenied
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, ok := a.credentials[sig.accessKeyID]
+	if !ok {
+		return nil, nil, errInvalidAccessKeyID
+	}
+
+	key := signingKey(c.SecretAccessKey, sig.scope)
+
+	stringToSign := strings.Join([]string{
+		algorithm,
+		sig.date.Format(amzDateFormat),
+		sig.scope,
+		sha256Hex([]byte(canonicalRequest(r, sig))),
+	}, "\n")
+
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(key, stringToSign))), []byte(sig.signature)) {
+		return nil, nil, errSignatureDoesNotMatch
+	}
+
+	p := &payload{r: r.Body, c: r.Body}
+
+	switch sig.payloadHash {
+	case unsignedHash:
+	case streamingHash:
+		p.r = &chunkedReader{
+			r:     bufio.NewReader(p.r),
+			key:   key,
+			date:  sig.date.Format(amzDateFormat),
+			scope: sig.scope,
+			prev:  sig.signature,
+		}
+
+		if n, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			r.ContentLength = n
+		}
+	default:
+		want, err := hex.DecodeString(sig.payloadHash)
+		if err != nil || len(want) != sha256.Size {
+			return nil, nil, errContentSHA256Mismatch
+		}
+
+		p.r = &verifyReader{r: p.r, h: sha256.New(), want: want, err: errContentSHA256Mismatch}
+	}
+
+	if s := r.Header.Get("Content-MD5"); s != "" {
+		want, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(want) != md5.Size {
+			return nil, nil, errInvalidDigest
+		}
+
+		p.r = &verifyReader{r: p.r, h: md5.New(), want: want, err: errBadDigest}
+	}
+
+	return &c, p, nil
+}
+
+// parseAuthorization parses the Authorization header of a signed request.
+func parseAuthorization(r *http.Request, auth string) (*signature, error) {
+	fields := make(map[string]string)
+
+	for _, f := range strings.Split(strings.TrimPrefix(auth, algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, errAuthorizationHeader
+		}
+
+		fields[kv[0]] = kv[1]
+	}
+
+	sig, err := parseCredential(fields["Credential"])
+	if err != nil {
+		return nil, err
+	}
+
+	sig.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	sig.signature = fields["Signature"]
+	sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+
+	if sig.signature == "" || fields["SignedHeaders"] == "" {
+		return nil, errAuthorizationHeader
+	}
+
+	if sig.payloadHash == "" {
+		return nil, errMissingContentSHA256
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		date = r.Header.Get("Date")
+	}
+
+	if err := sig.setDate(date); err != nil {
+		return nil, err
+	}
+
+	if d := now().Sub(sig.date); d > maxSkew || d < -maxSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+
+	return sig, nil
+}
+
+// parsePresigned parses the query string of a presigned URL.
+func parsePresigned(r *http.Request) (*signature, error) {
+	q := r.URL.Query()
+
+	sig, err := parseCredential(q.Get("X-Amz-Credential"))
+	if err != nil {
+		return nil, err
+	}
+
+	sig.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	sig.signature = q.Get("X-Amz-Signature")
+	sig.payloadHash = unsignedHash
+	sig.presigned = true
+
+	if err := sig.setDate(q.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxExpires {
+		return nil, errAuthorizationHeader
+	}
+
+	switch t := now(); {
+	case sig.date.After(t.Add(maxSkew)):
+		return nil, errRequestTimeTooSkewed
+	case t.After(sig.date.Add(time.Duration(expires) * time.Second)):
+		return nil, errExpiredToken
+	}
+
+	return sig, nil
+}
+
+// parseCredential parses "<access key>/<date>/<region>/s3/aws4_request".
+func parseCredential(credential string) (*signature, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return nil, errAuthorizationHeader
+	}
+
+	return &signature{
+		accessKeyID: parts[0],
+		scope:       strings.Join(parts[1:], "/"),
+	}, nil
+}
+
+// setDate sets the date of the signature, which must match the date of the
+// credential scope.
+func (sig *signature) setDate(s string) error {
+	t, err := time.Parse(amzDateFormat, s)
+	if err != nil {
+		if t, err = http.ParseTime(s); err != nil {
+			return errAuthorizationHeader
+		}
+	}
+
+	if !strings.HasPrefix(sig.scope, t.UTC().Format("20060102")+"/") {
+		return errAuthorizationHeader
+	}
+
+	sig.date = t.UTC()
+
+	return nil
+}
+
+// canonicalRequest returns the canonical request of r, see
+// https://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
+func canonicalRequest(r *http.Request, sig *signature) string {
+	var (
+		params  [][2]string
+		query   []string
+		headers []string
+	)
+
+	for k, vs := range r.URL.Query() {
+		if sig.presigned && k == "X-Amz-Signature" {
+			continue
+		}
+
+		for _, v := range vs {
+			params = append(params, [2]string{uriEncode(k, true), uriEncode(v, true)})
+		}
+	}
+
+	// Parameters are sorted by name, then by value.
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+
+		return params[i][1] < params[j][1]
+	})
+
+	for _, p := range params {
+		query = append(query, p[0]+"="+p[1])
+	}
+
+	for _, h := range sig.signedHeaders {
+		var values []string
+
+		switch h {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		case "transfer-encoding":
+			values = r.TransferEncoding
+		default:
+			values = r.Header[http.CanonicalHeaderKey(h)]
+		}
+
+		trimmed := make([]string, len(values))
+
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+
+		headers = append(headers, h+":"+strings.Join(trimmed, ",")+"\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		strings.Join(query, "&"),
+		strings.Join(headers, ""),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+// uriEncode encodes s as specified for AWS Signature Version 4, i.e. all
+// characters except unreserved ones (and slashes, if encodeSlash is false).
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// signingKey derives the signing key from the secret access key and the
+// credential scope "<date>/<region>/<service>/aws4_request".
+func signingKey(secret string, scope string) []byte {
+	key := []byte("AWS4" + secret)
+
+	for _, s := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, s)
+	}
+
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// payload is the verified body of a request. Verification errors are kept,
+// since the readers consuming the body (e.g. the HTTP client uploading it to
+// myCloud) do not return them unmodified.
+type payload struct {
+	r   io.Reader
+	c   io.Closer
+	err error
+}
+
+func (p *payload) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+
+	if e, ok := err.(*apiError); ok {
+		p.err = e
+	}
+
+	return n, err
+}
+
+// Close closes the request body.
+func (p *payload) Close() error {
+	return p.c.Close()
+}
+
+// Err returns the verification error, if any.
+func (p *payload) Err() error {
+	return p.err
+}
+
+// verifyReader returns err at the end of r if the hash of the data read does
+// not match want.
+type verifyReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+	err  error
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+
+	if err == io.EOF && !bytes.Equal(v.h.Sum(nil), v.want) {
+		return n, v.err
+	}
+
+	return n, err
+}
+
+// chunkedReader decodes a body sent with "aws-chunked" content encoding and
+// verifies the signature of each chunk, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+type chunkedReader struct {
+	r     *bufio.Reader
+	key   []byte
+	date  string
+	scope string
+	prev  string
+	buf   []byte
+	err   error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		c.err = c.next()
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+// next reads and verifies the next chunk. It returns io.EOF after the last
+// (empty) chunk.
+func (c *chunkedReader) next() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return errIncompleteBody
+	}
+
+	header := strings.SplitN(strings.TrimRight(string(line), "\r\n"), ";chunk-signature=", 2)
+	if len(header) != 2 {
+		return errIncompleteBody
+	}
+
+	size, err := strconv.ParseInt(header[0], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errIncompleteBody
+	}
+
+	data := make([]byte, size+2)
+
+	if _, err := io.ReadFull(c.r, data); err != nil || !bytes.HasSuffix(data, []byte("\r\n")) {
+		return errIncompleteBody
+	}
+
+	data = data[:size]
+
+	stringToSign := strings.Join([]string{
+		algorithm + "-PAYLOAD",
+		c.date,
+		c.scope,
+		c.prev,
+		emptySHA256Hex,
+		sha256Hex(data),
+	}, "\n")
+
+	sig := hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+
+	if !hmac.Equal([]byte(sig), []byte(header[1])) {
+		return errSignatureDoesNotMatch
+	}
+
+	c.prev = sig
+
+	if size == 0 {
+		return io.EOF
+	}
+
+	c.buf = data
+
+	return nil
+}
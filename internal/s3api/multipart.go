@@ -0,0 +1,244 @@
+package s3api
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// maxParts is the highest part number of a multipart upload.
+const maxParts = 10000
+
+// upload represents a multipart upload in progress. Parts are stored in a
+// local directory and assembled when the upload is completed.
+type upload struct {
+	username string
+	bucket   string
+	key      string
+	path     string
+	dir      string
+
+	mu    sync.Mutex
+	parts map[int]string
+}
+
+// part returns the local path of the part with the given number.
+func (u *upload) part(n int) string {
+	return filepath.Join(u.dir, fmt.Sprintf("part-%05d", n))
+}
+
+// remove removes all parts of the upload.
+func (u *upload) remove() {
+	if err := os.RemoveAll(u.dir); err != nil {
+		log.Error("os.RemoveAll(%s): %v", u.dir, err)
+	}
+}
+
+// lookup returns the multipart upload with the given ID, if it belongs to
+// the user and the object of the request.
+func (a *API) lookup(q *request, id string) (*upload, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u, ok := a.uploads[id]
+	if !ok || u.username != q.user || u.bucket != q.bucket || u.key != q.key {
+		return nil, errNoSuchUpload
+	}
+
+	return u, nil
+}
+
+// createMultipartUpload implements CreateMultipartUpload.
+func (a *API) createMultipartUpload(q *request) error {
+	p, err := objectPath(q.bucket, q.key)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(p, "/") {
+		return errInvalidKey
+	}
+
+	if err := a.headBucket(q); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(a.o.MultipartDir, "scmc-s3-")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempDir: %v", err)
+	}
+
+	id := uuid.New().String()
+
+	a.mu.Lock()
+	a.uploads[id] = &upload{
+		username: q.user,
+		bucket:   q.bucket,
+		key:      q.key,
+		path:     p,
+		dir:      dir,
+		parts:    make(map[int]string),
+	}
+	a.mu.Unlock()
+
+	log.Debug("created multipart upload %s for %s", id, p)
+
+	return writeXML(q.w, http.StatusOK, initiateMultipartUploadResult{
+		Bucket:   q.bucket,
+		Key:      q.key,
+		UploadID: id,
+	})
+}
+
+// uploadPart implements UploadPart. A part uploaded again replaces the
+// previous one.
+func (a *API) uploadPart(q *request, id string) error {
+	u, err := a.lookup(q, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(q.r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxParts {
+		return errInvalidArgument
+	}
+
+	f, err := ioutil.TempFile(u.dir, "tmp-")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %v", err)
+	}
+
+	defer os.Remove(f.Name())
+
+	h := md5.New()
+
+	_, err = io.Copy(io.MultiWriter(f, h), q.body)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if perr := q.body.Err(); perr != nil {
+		return perr
+	}
+
+	if err != nil {
+		return fmt.Errorf("write part %d of %s: %v", n, id, err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := os.Rename(f.Name(), u.part(n)); err != nil {
+		return fmt.Errorf("os.Rename: %v", err)
+	}
+
+	u.parts[n] = sum
+
+	q.w.Header().Set("ETag", `"`+sum+`"`)
+	q.w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// completeMultipartUpload implements CompleteMultipartUpload. The parts are
+// concatenated and uploaded as a single file, whose ETag is the hash reported
+// by myCloud like for any other object.
+func (a *API) completeMultipartUpload(q *request, id string) error {
+	u, err := a.lookup(q, id)
+	if err != nil {
+		return err
+	}
+
+	var c completeMultipartUpload
+
+	if err := xml.NewDecoder(q.body).Decode(&c); err != nil {
+		if perr := q.body.Err(); perr != nil {
+			return perr
+		}
+
+		return errMalformedXML
+	}
+
+	if len(c.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var readers []io.Reader
+
+	for i, p := range c.Parts {
+		if i > 0 && p.PartNumber <= c.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+
+		sum, ok := u.parts[p.PartNumber]
+		if !ok || sum != strings.Trim(p.ETag, `"`) {
+			return errInvalidPart
+		}
+
+		f, err := os.Open(u.part(p.PartNumber))
+		if err != nil {
+			return fmt.Errorf("os.Open: %v", err)
+		}
+
+		defer f.Close()
+
+		readers = append(readers, f)
+	}
+
+	tag, err := store(q, u.path, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	delete(a.uploads, id)
+	a.mu.Unlock()
+
+	u.remove()
+
+	log.Debug("completed multipart upload %s of %s (%d parts)", id, u.path, len(c.Parts))
+
+	return writeXML(q.w, http.StatusOK, completeMultipartUploadResult{
+		Location: "/" + q.bucket + "/" + q.key,
+		Bucket:   q.bucket,
+		Key:      q.key,
+		ETag:     tag,
+	})
+}
+
+// abortMultipartUpload implements AbortMultipartUpload.
+func (a *API) abortMultipartUpload(q *request, id string) error {
+	u, err := a.lookup(q, id)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	delete(a.uploads, id)
+	a.mu.Unlock()
+
+	u.mu.Lock()
+	u.remove()
+	u.mu.Unlock()
+
+	q.w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
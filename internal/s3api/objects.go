@@ -0,0 +1,601 @@
+package s3api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxKeys is the default and maximum number of keys returned by a listing.
+const maxKeys = 1000
+
+// emptyMD5 is the ETag of empty objects, e.g. directory markers.
+const emptyMD5 = `"d41d8cd98f00b204e9800998ecf8427e"`
+
+// listBuckets lists the top-level directories of the Drive.
+func (a *API) listBuckets(q *request) error {
+	entries, err := list(q.mc, "/")
+	if err != nil {
+		return err
+	}
+
+	res := listAllMyBucketsResult{
+		Owner:   owner{ID: q.user, DisplayName: q.user},
+		Buckets: []bucket{},
+	}
+
+	for _, e := range entries {
+		if e.dir {
+			res.Buckets = append(res.Buckets, bucket{Name: e.name, CreationDate: e.mtime.UTC().Format(timeFormat)})
+		}
+	}
+
+	sort.Slice(res.Buckets, func(i, j int) bool { return res.Buckets[i].Name < res.Buckets[j].Name })
+
+	return writeXML(q.w, http.StatusOK, res)
+}
+
+// getBucketLocation returns the configured region.
+func (a *API) getBucketLocation(q *request) error {
+	if err := a.headBucket(q); err != nil {
+		return err
+	}
+
+	res := locationConstraint{}
+
+	// us-east-1 is represented by an empty location constraint.
+	if a.o.Region != "us-east-1" {
+		res.Location = a.o.Region
+	}
+
+	return writeXML(q.w, http.StatusOK, res)
+}
+
+// headBucket checks whether a bucket exists. Nothing is written on success,
+// so that it can be used by other handlers.
+func (a *API) headBucket(q *request) error {
+	if _, err := q.mc.Metadata("/" + q.bucket + "/"); err != nil {
+		return mapError(err, errNoSuchBucket)
+	}
+
+	return nil
+}
+
+// createBucket creates a top-level directory.
+func (a *API) createBucket(q *request) error {
+	if err := a.headBucket(q); err == nil {
+		return errBucketExists
+	} else if err != errNoSuchBucket {
+		return err
+	}
+
+	if err := q.mc.CreateDirectory("/" + q.bucket + "/"); err != nil {
+		return mapError(err, errNoSuchBucket)
+	}
+
+	q.w.Header().Set("Location", "/"+q.bucket)
+	q.w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// deleteBucket removes a top-level directory if it is empty.
+func (a *API) deleteBucket(q *request) error {
+	entries, err := list(q.mc, "/"+q.bucket+"/")
+	if err != nil {
+		return mapError(err, errNoSuchBucket)
+	}
+
+	if len(entries) > 0 {
+		return errBucketNotEmpty
+	}
+
+	if err := q.mc.Delete([]string{"/" + q.bucket + "/"}); err != nil {
+		return mapError(err, errNoSuchBucket)
+	}
+
+	q.w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// listObjects implements both ListObjects and ListObjectsV2 (list-type=2).
+func (a *API) listObjects(q *request) error {
+	var (
+		query     = q.r.URL.Query()
+		v2        = query.Get("list-type") == "2"
+		prefix    = query.Get("prefix")
+		delimiter = query.Get("delimiter")
+		encode    = query.Get("encoding-type") == "url"
+		limit     = maxKeys
+		after     string
+	)
+
+	switch e := query.Get("encoding-type"); e {
+	case "", "url":
+	default:
+		return errInvalidArgument
+	}
+
+	if s := query.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+
+		if n < limit {
+			limit = n
+		}
+	}
+
+	if v2 {
+		after = query.Get("start-after")
+
+		if token := query.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return errInvalidArgument
+			}
+
+			after = string(b)
+		}
+	} else {
+		after = query.Get("marker")
+	}
+
+	if err := a.headBucket(q); err != nil {
+		return err
+	}
+
+	objects, prefixes, err := walk(q, prefix, delimiter)
+	if err != nil {
+		return err
+	}
+
+	// Objects and common prefixes are returned in a single sorted sequence.
+	type item struct {
+		key    string
+		object *object
+	}
+
+	var items []item
+
+	for i := range objects {
+		items = append(items, item{key: objects[i].Key, object: &objects[i]})
+	}
+
+	for p := range prefixes {
+		items = append(items, item{key: p})
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+
+	i := sort.Search(len(items), func(i int) bool { return items[i].key > after })
+	items = items[i:]
+
+	res := listBucketResult{
+		Name:           q.bucket,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
+		MaxKeys:        limit,
+		Contents:       []object{},
+		CommonPrefixes: []commonPrefix{},
+	}
+
+	// With max-keys=0, S3 returns an empty result which is not truncated.
+	if limit == 0 {
+		items = nil
+	} else if len(items) > limit {
+		items = items[:limit]
+		res.IsTruncated = true
+	}
+
+	esc := func(s string) string { return s }
+
+	if encode {
+		res.EncodingType = "url"
+		esc = url.QueryEscape
+	}
+
+	for _, it := range items {
+		if it.object != nil {
+			o := *it.object
+			o.Key = esc(o.Key)
+			res.Contents = append(res.Contents, o)
+		} else {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: esc(it.key)})
+		}
+	}
+
+	res.Prefix, res.Delimiter = esc(prefix), esc(delimiter)
+
+	if v2 {
+		n := len(items)
+		res.KeyCount = &n
+		res.ContinuationToken = query.Get("continuation-token")
+		res.StartAfter = esc(query.Get("start-after"))
+
+		if res.IsTruncated && len(items) > 0 {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(items[len(items)-1].key))
+		}
+	} else {
+		marker := esc(after)
+		res.Marker = &marker
+
+		if res.IsTruncated && len(items) > 0 {
+			res.NextMarker = esc(items[len(items)-1].key)
+		}
+	}
+
+	return writeXML(q.w, http.StatusOK, res)
+}
+
+// walk returns the objects of a bucket whose keys start with prefix, as well
+// as the common prefixes if a delimiter is given. With the delimiter "/",
+// only the directory containing the prefix is listed, otherwise all
+// directories below it are walked recursively.
+func walk(q *request, prefix string, delimiter string) ([]object, map[string]bool, error) {
+	var (
+		objects  []object
+		prefixes = make(map[string]bool)
+		dir      = prefix[:strings.LastIndex(prefix, "/")+1]
+	)
+
+	if _, err := objectPath(q.bucket, dir); err != nil {
+		// Such keys cannot exist.
+		return nil, prefixes, nil
+	}
+
+	var visit func(dir string) error
+
+	visit = func(dir string) error {
+		entries, err := list(q.mc, "/"+q.bucket+"/"+dir)
+		if err != nil {
+			if notFound(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		for _, e := range entries {
+			key := dir + e.name
+
+			if e.dir {
+				key += "/"
+
+				switch {
+				case delimiter == "/" && strings.HasPrefix(key, prefix):
+					prefixes[key] = true
+				case strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key):
+					if err := visit(key); err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			if delimiter != "" && delimiter != "/" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					prefixes[key[:len(prefix)+i+len(delimiter)]] = true
+					continue
+				}
+			}
+
+			objects = append(objects, object{
+				Key:          key,
+				LastModified: e.mtime.UTC().Format(timeFormat),
+				ETag:         etag(&e),
+				Size:         e.size,
+				StorageClass: "STANDARD",
+			})
+		}
+
+		return nil
+	}
+
+	if err := visit(dir); err != nil {
+		return nil, nil, err
+	}
+
+	return objects, prefixes, nil
+}
+
+// setObjectHeaders sets the headers describing an object.
+func setObjectHeaders(w http.ResponseWriter, e *entry) {
+	w.Header().Set("Last-Modified", e.mtime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if e.etag != "" {
+		w.Header().Set("ETag", etag(e))
+	}
+
+	if e.mime != "" {
+		w.Header().Set("Content-Type", e.mime)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+}
+
+// getObject implements GetObject and HeadObject.
+func (a *API) getObject(q *request) error {
+	p, err := objectPath(q.bucket, q.key)
+	if err != nil {
+		return errNoSuchKey
+	}
+
+	e, err := stat(q.mc, p)
+	if err != nil {
+		return mapError(err, errNoSuchKey)
+	}
+
+	setObjectHeaders(q.w, e)
+
+	if e.dir {
+		// Directories are represented as empty objects.
+		q.w.Header().Set("ETag", emptyMD5)
+		q.w.Header().Set("Content-Length", "0")
+		q.w.WriteHeader(http.StatusOK)
+
+		return nil
+	}
+
+	if q.r.Method == http.MethodHead {
+		q.w.Header().Set("Content-Length", strconv.FormatInt(e.size, 10))
+		q.w.WriteHeader(http.StatusOK)
+
+		return nil
+	}
+
+	response, err := q.mc.OpenFile(p, q.r.Header.Get("Range"))
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		q.w.Header().Set("Content-Range", response.Header.Get("Content-Range"))
+	case http.StatusRequestedRangeNotSatisfiable:
+		q.w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", e.size))
+		return errInvalidRange
+	case http.StatusNotFound:
+		return errNoSuchKey
+	default:
+		return fmt.Errorf("got status code %d from myCloud", response.StatusCode)
+	}
+
+	if response.ContentLength >= 0 {
+		q.w.Header().Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+	}
+
+	q.w.WriteHeader(response.StatusCode)
+
+	if _, err := io.Copy(q.w, response.Body); err != nil {
+		return fmt.Errorf("io.Copy: %v", err)
+	}
+
+	return nil
+}
+
+// putObject implements PutObject and CopyObject. Objects whose keys end with
+// a slash create directories.
+func (a *API) putObject(q *request) error {
+	p, err := objectPath(q.bucket, q.key)
+	if err != nil {
+		return err
+	}
+
+	if err := a.headBucket(q); err != nil {
+		return err
+	}
+
+	if src := q.r.Header.Get("X-Amz-Copy-Source"); src != "" {
+		return a.copyObject(q, p, src)
+	}
+
+	if strings.HasSuffix(p, "/") {
+		if _, err := io.Copy(ioutil.Discard, q.body); err != nil {
+			return fmt.Errorf("io.Copy: %v", err)
+		}
+
+		if err := q.body.Err(); err != nil {
+			return err
+		}
+
+		if err := q.mc.CreateDirectory(p); err != nil {
+			return mapError(err, errNoSuchBucket)
+		}
+
+		q.w.Header().Set("ETag", emptyMD5)
+		q.w.WriteHeader(http.StatusOK)
+
+		return nil
+	}
+
+	f, err := a.spool(q, q.body)
+	if err != nil {
+		return err
+	}
+
+	defer discard(f)
+
+	tag, err := store(q, p, f)
+	if err != nil {
+		return err
+	}
+
+	if tag != "" {
+		q.w.Header().Set("ETag", tag)
+	}
+
+	q.w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// spool reads r into a temporary file in the multipart directory, so that
+// the payload is verified completely before an existing object is replaced.
+// The returned file is positioned at its start and has to be released with
+// discard.
+func (a *API) spool(q *request, r io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile(a.o.MultipartDir, "scmc-s3-")
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.TempFile: %v", err)
+	}
+
+	_, err = io.Copy(f, r)
+
+	if perr := q.body.Err(); perr != nil {
+		discard(f)
+		return nil, perr
+	}
+
+	if err != nil {
+		discard(f)
+		return nil, fmt.Errorf("io.Copy: %v", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		discard(f)
+		return nil, fmt.Errorf("f.Seek: %v", err)
+	}
+
+	return f, nil
+}
+
+// discard closes and removes a file created by spool.
+func discard(f *os.File) {
+	f.Close()
+
+	if err := os.Remove(f.Name()); err != nil {
+		log.Error("os.Remove(%s): %v", f.Name(), err)
+	}
+}
+
+// store uploads r, which must already be verified, to the myCloud path p and
+// returns the ETag of the stored object, i.e. the hash reported by myCloud,
+// so that the same ETag is returned by HeadObject and ListObjects. It is
+// empty if myCloud does not report a hash.
+func store(q *request, p string, r io.Reader) (string, error) {
+	if err := q.mc.CreateFile(p, r); err != nil {
+		return "", mapError(err, errNoSuchBucket)
+	}
+
+	e, err := stat(q.mc, p)
+	if err != nil {
+		log.Warn("unable to get the ETag of %s: %v", p, err)
+		return "", nil
+	}
+
+	if e.etag == "" {
+		return "", nil
+	}
+
+	return etag(e), nil
+}
+
+// copyObject copies the object given as "/bucket/key" to the myCloud path p.
+func (a *API) copyObject(q *request, p string, src string) error {
+	src, err := url.PathUnescape(src)
+	if err != nil {
+		return errInvalidArgument
+	}
+
+	if i := strings.Index(src, "?"); i >= 0 {
+		src = src[:i]
+	}
+
+	srcBucket, srcKey := splitPath("/" + strings.TrimPrefix(src, "/"))
+
+	srcPath, err := objectPath(srcBucket, srcKey)
+	if err != nil || strings.HasSuffix(srcPath, "/") {
+		return errNoSuchKey
+	}
+
+	if _, err := stat(q.mc, srcPath); err != nil {
+		return mapError(err, errNoSuchKey)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(q.mc.GetFile(srcPath, pw, ""))
+	}()
+
+	f, err := a.spool(q, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+
+	if err != nil {
+		return err
+	}
+
+	defer discard(f)
+
+	tag, err := store(q, p, f)
+	if err != nil {
+		return err
+	}
+
+	return writeXML(q.w, http.StatusOK, copyObjectResult{
+		LastModified: time.Now().UTC().Format(timeFormat),
+		ETag:         tag,
+	})
+}
+
+// deleteObject removes an object. Directories are only removed if they are
+// empty, since myCloud deletes them recursively. Deleting a missing object
+// succeeds.
+func (a *API) deleteObject(q *request) error {
+	p, err := objectPath(q.bucket, q.key)
+	if err != nil {
+		q.w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if _, err := stat(q.mc, p); err != nil {
+		if !notFound(err) {
+			return err
+		}
+
+		q.w.WriteHeader(http.StatusNoContent)
+
+		return nil
+	}
+
+	if strings.HasSuffix(p, "/") {
+		entries, err := list(q.mc, p)
+		if err != nil {
+			return mapError(err, errNoSuchKey)
+		}
+
+		// The directory remains as long as it has children.
+		if len(entries) > 0 {
+			q.w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+
+	if err := q.mc.Delete([]string{p}); err != nil {
+		return mapError(err, errNoSuchKey)
+	}
+
+	q.w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
@@ -0,0 +1,390 @@
+// Package s3api implements a subset of the Amazon S3 REST API on top of
+// myCloud. Buckets are the top-level directories of the myCloud Drive of the
+// account an access key is mapped to, objects are the files below them.
+package s3api
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/virvum/scmc/internal/accesslog"
+	"github.com/virvum/scmc/internal/sessions"
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"github.com/google/uuid"
+)
+
+var log logger.Log
+
+// Options represents options of the S3 API.
+type Options struct {
+	// Credentials are the access keys which may access the API.
+	Credentials []Credentials
+	// Region is returned by GetBucketLocation.
+	Region string
+	// MultipartDir is the directory in which parts of multipart uploads are
+	// stored until the upload is completed, and in which uploaded objects are
+	// spooled until their payload is verified (os.TempDir() if empty).
+	MultipartDir string
+	// ReadOnly rejects all write operations.
+	ReadOnly bool
+	// AccessLog, if set, receives an entry for each request. Otherwise
+	// requests are logged as informational messages.
+	AccessLog *accesslog.Logger
+}
+
+// API represents the S3 API.
+type API struct {
+	o           Options
+	credentials map[string]Credentials
+	sessions    *sessions.Pool
+
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+// request represents an authenticated request to a bucket or an object.
+type request struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	mc     *mycloud.MyCloud
+	user   string
+	body   *payload
+	bucket string
+	key    string
+}
+
+// New creates an S3 API.
+func New(l logger.Log, o Options) (*API, error) {
+	log = l
+
+	if o.MultipartDir == "" {
+		o.MultipartDir = os.TempDir()
+	}
+
+	if err := os.MkdirAll(o.MultipartDir, 0700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(%s): %v", o.MultipartDir, err)
+	}
+
+	a := &API{
+		o:           o,
+		credentials: make(map[string]Credentials),
+		sessions:    sessions.New(l),
+		uploads:     make(map[string]*upload),
+	}
+
+	for _, c := range o.Credentials {
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return nil, fmt.Errorf("access key ID and secret access key of %s must be set", c.Username)
+		}
+
+		if _, ok := a.credentials[c.AccessKeyID]; ok {
+			return nil, fmt.Errorf("access key ID %s is used more than once", c.AccessKeyID)
+		}
+
+		a.credentials[c.AccessKeyID] = c
+	}
+
+	return a, nil
+}
+
+// Close aborts all multipart uploads in progress.
+func (a *API) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for id, u := range a.uploads {
+		u.remove()
+		delete(a.uploads, id)
+	}
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		start     = time.Now()
+		rec       = accesslog.NewRecorder(w)
+		body      = accesslog.NewCounter(r.Body)
+		requestID = strings.ToUpper(strings.Replace(uuid.New().String(), "-", "", -1)[:16])
+		username  string
+		err       error
+	)
+
+	r.Body = body
+
+	rec.Header().Set("X-Amz-Request-Id", requestID)
+	rec.Header().Set("Server", "scmc")
+
+	defer func() {
+		a.logRequest(r, username, rec, body.Count(), time.Since(start), err)
+	}()
+
+	if err = a.serve(rec, r, &username); err != nil {
+		a.writeError(rec, r, requestID, err)
+	}
+}
+
+// serve authenticates and dispatches a request.
+func (a *API) serve(w http.ResponseWriter, r *http.Request, username *string) error {
+	c, body, err := a.authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	*username = c.Username
+
+	mc, err := a.sessions.Login(c.Username, c.Password)
+	if err != nil {
+		log.Error("login of %s failed: %v", c.Username, err)
+		return errLoginFailed
+	}
+
+	q := &request{w: w, r: r, mc: mc, user: c.Username, body: body}
+	q.bucket, q.key = splitPath(r.URL.Path)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && (a.o.ReadOnly || c.ReadOnly) {
+		return errReadOnly
+	}
+
+	if q.bucket != "" && (q.bucket == "." || q.bucket == "..") {
+		return errInvalidBucketName
+	}
+
+	query := r.URL.Query()
+
+	for _, sub := range []string{"acl", "policy", "tagging", "versioning", "versions", "lifecycle", "cors", "website", "encryption", "logging", "notification", "replication", "object-lock", "retention", "legal-hold", "select", "restore", "torrent"} {
+		if _, ok := query[sub]; ok {
+			return errNotImplemented
+		}
+	}
+
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case q.bucket == "":
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+
+		return a.listBuckets(q)
+	case q.key == "":
+		switch r.Method {
+		case http.MethodGet:
+			if _, ok := query["location"]; ok {
+				return a.getBucketLocation(q)
+			}
+
+			if uploads {
+				return errNotImplemented
+			}
+
+			return a.listObjects(q)
+		case http.MethodHead:
+			return a.headBucket(q)
+		case http.MethodPut:
+			return a.createBucket(q)
+		case http.MethodDelete:
+			return a.deleteBucket(q)
+		case http.MethodPost:
+			if _, ok := query["delete"]; ok {
+				return errNotImplemented
+			}
+		}
+
+		return errMethodNotAllowed
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" {
+			return errNotImplemented
+		}
+
+		return a.getObject(q)
+	case http.MethodPut:
+		if uploadID != "" {
+			return a.uploadPart(q, uploadID)
+		}
+
+		return a.putObject(q)
+	case http.MethodDelete:
+		if uploadID != "" {
+			return a.abortMultipartUpload(q, uploadID)
+		}
+
+		return a.deleteObject(q)
+	case http.MethodPost:
+		switch {
+		case uploads:
+			return a.createMultipartUpload(q)
+		case uploadID != "":
+			return a.completeMultipartUpload(q, uploadID)
+		}
+	}
+
+	return errMethodNotAllowed
+}
+
+// splitPath splits the path of a path-style request into bucket and key.
+func splitPath(p string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// objectPath returns the myCloud path of the given object. Keys which do
+// not map to a unique path (e.g. containing empty or relative components)
+// are rejected. Keys ending with a slash denote directories.
+func objectPath(bucket string, key string) (string, error) {
+	p := "/" + bucket + "/" + key
+	c := path.Clean(p)
+
+	if strings.HasSuffix(p, "/") && c != "/" {
+		c += "/"
+	}
+
+	if c != p {
+		return "", errInvalidKey
+	}
+
+	return p, nil
+}
+
+// list returns the entries of the myCloud directory dir (ending with a slash).
+func list(mc *mycloud.MyCloud, dir string) ([]entry, error) {
+	m, err := mc.Metadata(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]entry, 0, len(m.Directories)+len(m.Files))
+
+	for _, d := range m.Directories {
+		entries = append(entries, entry{name: d.Name, dir: true, mtime: d.ModificationTime})
+	}
+
+	for _, f := range m.Files {
+		entries = append(entries, entry{name: f.Name, size: int64(f.Length), mtime: f.ModificationTime, etag: f.Etag, mime: f.Mime})
+	}
+
+	return entries, nil
+}
+
+// stat returns the entry of the file or directory (ending with a slash) at
+// the myCloud path p.
+func stat(mc *mycloud.MyCloud, p string) (*entry, error) {
+	var (
+		dir  = strings.HasSuffix(p, "/")
+		name = path.Base(p)
+	)
+
+	entries, err := list(mc, path.Dir(strings.TrimSuffix(p, "/"))+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.name == name && e.dir == dir {
+			return &e, nil
+		}
+	}
+
+	return nil, errNoSuchKey
+}
+
+// notFound returns true if err is a "404 Not Found" response of myCloud.
+func notFound(err error) bool {
+	return err == errNoSuchKey || mycloud.StatusCode(err) == http.StatusNotFound
+}
+
+// mapError maps errors returned by the myCloud API to S3 errors.
+func mapError(err error, notFoundErr *apiError) error {
+	switch {
+	case notFound(err):
+		return notFoundErr
+	case mycloud.StatusCode(err) == http.StatusForbidden:
+		return errAccessDenied
+	case mycloud.StatusCode(err) == http.StatusConflict:
+		return errConflict
+	}
+
+	return err
+}
+
+// etag returns the quoted ETag of an entry.
+func etag(e *entry) string {
+	return `"` + strings.Trim(e.etag, `"`) + `"`
+}
+
+// writeXML writes an XML response.
+func writeXML(w http.ResponseWriter, status int, v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("xml.Marshal: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+
+	return nil
+}
+
+// writeError writes an S3 error response, unless a response has already
+// been written.
+func (a *API) writeError(rec *accesslog.Recorder, r *http.Request, requestID string, err error) {
+	if rec.Written() {
+		return
+	}
+
+	e, ok := err.(*apiError)
+	if !ok {
+		log.Error("%s %s: %v", r.Method, r.URL.Path, err)
+		e = errInternal
+	}
+
+	if r.Method == http.MethodHead {
+		rec.WriteHeader(e.status)
+		return
+	}
+
+	writeXML(rec, e.status, errorResponse{
+		Code:      e.code,
+		Message:   e.message,
+		Resource:  r.URL.Path,
+		RequestID: requestID,
+	})
+}
+
+// logRequest writes a request to the access log or, if the access log is
+// disabled, logs it as informational message.
+func (a *API) logRequest(r *http.Request, username string, rec *accesslog.Recorder, received uint64, d time.Duration, err error) {
+	if a.o.AccessLog != nil {
+		a.o.AccessLog.Log(accesslog.NewEntry(r, username, rec, received, d, err))
+		return
+	}
+
+	result := "OK"
+
+	if err != nil {
+		result = fmt.Sprintf("error: %s", err)
+	}
+
+	if httpRange := r.Header.Get("Range"); httpRange != "" {
+		log.Info("%s %s %s -> %d %s", r.Method, r.URL.Path, httpRange, rec.Status(), result)
+	} else {
+		log.Info("%s %s -> %d %s", r.Method, r.URL.Path, rec.Status(), result)
+	}
+}
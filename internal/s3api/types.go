@@ -0,0 +1,164 @@
+package s3api
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+)
+
+// timeFormat is the format of timestamps in XML responses.
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// Credentials maps an S3 access key to a myCloud account.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Username        string
+	Password        string
+	ReadOnly        bool
+}
+
+// entry is a file or directory of a myCloud listing.
+type entry struct {
+	name  string
+	dir   bool
+	size  int64
+	mtime time.Time
+	etag  string
+	mime  string
+}
+
+type owner struct {
+	ID          string
+	DisplayName string
+}
+
+type bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+type object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+// listBucketResult is the result of both ListObjects and ListObjectsV2.
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	Contents              []object
+	CommonPrefixes        []commonPrefix
+}
+
+type locationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+// apiError is an error which is returned to the client as S3 error response.
+type apiError struct {
+	code    string
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+// S3 errors, see https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+var (
+	errAccessDenied          = &apiError{"AccessDenied", http.StatusForbidden, "Access Denied"}
+	errReadOnly              = &apiError{"AccessDenied", http.StatusForbidden, "Write operations are not permitted for this account"}
+	errLoginFailed           = &apiError{"AccessDenied", http.StatusForbidden, "The myCloud login of the account failed"}
+	errSignatureV2           = &apiError{"AccessDenied", http.StatusForbidden, "Only AWS Signature Version 4 is supported"}
+	errInvalidAccessKeyID    = &apiError{"InvalidAccessKeyId", http.StatusForbidden, "The access key ID you provided does not exist in our records"}
+	errSignatureDoesNotMatch = &apiError{"SignatureDoesNotMatch", http.StatusForbidden, "The request signature we calculated does not match the signature you provided"}
+	errAuthorizationHeader   = &apiError{"AuthorizationHeaderMalformed", http.StatusBadRequest, "The authorization header is malformed"}
+	errMissingContentSHA256  = &apiError{"InvalidRequest", http.StatusBadRequest, "Missing required header for this request: x-amz-content-sha256"}
+	errRequestTimeTooSkewed  = &apiError{"RequestTimeTooSkewed", http.StatusForbidden, "The difference between the request time and the server's time is too large"}
+	errExpiredToken          = &apiError{"AccessDenied", http.StatusForbidden, "Request has expired"}
+	errContentSHA256Mismatch = &apiError{"XAmzContentSHA256Mismatch", http.StatusBadRequest, "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	errBadDigest             = &apiError{"BadDigest", http.StatusBadRequest, "The Content-MD5 you specified did not match what we received"}
+	errInvalidDigest         = &apiError{"InvalidDigest", http.StatusBadRequest, "The Content-MD5 you specified is not valid"}
+	errIncompleteBody        = &apiError{"IncompleteBody", http.StatusBadRequest, "You did not provide the number of bytes specified by the Content-Length HTTP header"}
+	errNoSuchBucket          = &apiError{"NoSuchBucket", http.StatusNotFound, "The specified bucket does not exist"}
+	errNoSuchKey             = &apiError{"NoSuchKey", http.StatusNotFound, "The specified key does not exist"}
+	errNoSuchUpload          = &apiError{"NoSuchUpload", http.StatusNotFound, "The specified multipart upload does not exist"}
+	errBucketExists          = &apiError{"BucketAlreadyOwnedByYou", http.StatusConflict, "Your previous request to create the named bucket succeeded and you already own it"}
+	errBucketNotEmpty        = &apiError{"BucketNotEmpty", http.StatusConflict, "The bucket you tried to delete is not empty"}
+	errInvalidBucketName     = &apiError{"InvalidBucketName", http.StatusBadRequest, "The specified bucket is not valid"}
+	errInvalidKey            = &apiError{"InvalidArgument", http.StatusBadRequest, "The specified key cannot be mapped to a myCloud path"}
+	errInvalidArgument       = &apiError{"InvalidArgument", http.StatusBadRequest, "Invalid argument"}
+	errInvalidRange          = &apiError{"InvalidRange", http.StatusRequestedRangeNotSatisfiable, "The requested range is not satisfiable"}
+	errInvalidPart           = &apiError{"InvalidPart", http.StatusBadRequest, "One or more of the specified parts could not be found or the ETags do not match"}
+	errInvalidPartOrder      = &apiError{"InvalidPartOrder", http.StatusBadRequest, "The list of parts was not in ascending order"}
+	errMalformedXML          = &apiError{"MalformedXML", http.StatusBadRequest, "The XML you provided was not well-formed or did not validate against our published schema"}
+	errConflict              = &apiError{"InvalidRequest", http.StatusConflict, "The object conflicts with an existing file or directory"}
+	errMethodNotAllowed      = &apiError{"MethodNotAllowed", http.StatusMethodNotAllowed, "The specified method is not allowed against this resource"}
+	errNotImplemented        = &apiError{"NotImplemented", http.StatusNotImplemented, "A header or query parameter you provided implies functionality that is not implemented"}
+	errInternal              = &apiError{"InternalError", http.StatusInternalServerError, "We encountered an internal error, please try again"}
+)
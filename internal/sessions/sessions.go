@@ -0,0 +1,125 @@
+// Package sessions keeps the myCloud sessions of the users of the servers
+// provided by scmc, so that each user logs in to myCloud only once.
+package sessions
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"sync"
+
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// Pool holds authenticated myCloud sessions by username.
+type Pool struct {
+	// connect logs in to myCloud. Tests replace it to work without network.
+	connect func(username string, password string) (*mycloud.MyCloud, error)
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	logins   map[string]*login
+}
+
+// session is a myCloud session along with the hash of the password which
+// was used to create it.
+type session struct {
+	mc   *mycloud.MyCloud
+	hash [sha256.Size]byte
+}
+
+// login is a login to myCloud in progress. Concurrent requests of the same
+// user wait for it instead of logging in again.
+type login struct {
+	hash [sha256.Size]byte
+	done chan struct{}
+	mc   *mycloud.MyCloud
+	err  error
+}
+
+// New creates an empty pool. Sessions are created with the given options.
+func New(l logger.Log, options ...mycloud.Option) *Pool {
+	return &Pool{
+		connect: func(username string, password string) (*mycloud.MyCloud, error) {
+			return mycloud.New(username, password, l, options...)
+		},
+		sessions: make(map[string]*session),
+		logins:   make(map[string]*login),
+	}
+}
+
+// Login returns the session of the given user, logging in to myCloud if no
+// session exists yet. An existing session is only returned if the password
+// matches the one used to create it, otherwise the user logs in again. The
+// pool is not locked while logging in, so that other users are not blocked.
+func (p *Pool) Login(username string, password string) (*mycloud.MyCloud, error) {
+	hash := sha256.Sum256([]byte(password))
+
+	for {
+		p.mu.Lock()
+
+		if s, ok := p.sessions[username]; ok && subtle.ConstantTimeCompare(s.hash[:], hash[:]) == 1 {
+			p.mu.Unlock()
+			return s.mc, nil
+		}
+
+		l, ok := p.logins[username]
+		if !ok {
+			break
+		}
+
+		p.mu.Unlock()
+
+		<-l.done
+
+		// The result of a login with another password is not used, the
+		// session is looked up again instead.
+		if subtle.ConstantTimeCompare(l.hash[:], hash[:]) == 1 {
+			return l.mc, l.err
+		}
+	}
+
+	l := &login{hash: hash, done: make(chan struct{})}
+	p.logins[username] = l
+	p.mu.Unlock()
+
+	l.mc, l.err = p.connect(username, password)
+	if l.err != nil {
+		l.mc, l.err = nil, fmt.Errorf("mycloud.New: %v", l.err)
+	}
+
+	p.mu.Lock()
+	delete(p.logins, username)
+
+	if l.err == nil {
+		p.sessions[username] = &session{mc: l.mc, hash: hash}
+	}
+
+	p.mu.Unlock()
+
+	close(l.done)
+
+	return l.mc, l.err
+}
+
+// Session returns the session of the given user, or nil if the user has not
+// logged in yet.
+func (p *Pool) Session(username string) *mycloud.MyCloud {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.sessions[username]; ok {
+		return s.mc
+	}
+
+	return nil
+}
+
+// Len returns the number of sessions.
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.sessions)
+}
@@ -0,0 +1,151 @@
+package sessions
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/virvum/scmc/pkg/logger"
+	"github.com/virvum/scmc/pkg/mycloud"
+)
+
+// fakePool returns a pool whose logins succeed unless the password is
+// "wrong", and a counter of the logins.
+func fakePool() (*Pool, *int32) {
+	var n int32
+
+	p := New(logger.New(logger.Error, false, ""))
+	p.connect = func(username string, password string) (*mycloud.MyCloud, error) {
+		atomic.AddInt32(&n, 1)
+
+		if password == "wrong" {
+			return nil, errors.New("authentication failed")
+		}
+
+		return &mycloud.MyCloud{}, nil
+	}
+
+	return p, &n
+}
+
+func TestLogin(t *testing.T) {
+	type login struct {
+		username string
+		password string
+		err      bool
+		same     bool // the session of the previous login is returned
+	}
+
+	tests := []struct {
+		name   string
+		logins []login
+		n      int32
+	}{
+		{
+			name: "same password reuses the session",
+			logins: []login{
+				{"alice", "secret", false, false},
+				{"alice", "secret", false, true},
+			},
+			n: 1,
+		},
+		{
+			name: "other password logs in again",
+			logins: []login{
+				{"alice", "secret", false, false},
+				{"alice", "other", false, false},
+				{"alice", "other", false, true},
+			},
+			n: 2,
+		},
+		{
+			name: "wrong password fails and keeps the session",
+			logins: []login{
+				{"alice", "secret", false, false},
+				{"alice", "wrong", true, false},
+				{"alice", "secret", false, true},
+			},
+			n: 2,
+		},
+		{
+			name: "users have separate sessions",
+			logins: []login{
+				{"alice", "secret", false, false},
+				{"bob", "secret", false, false},
+			},
+			n: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, n := fakePool()
+
+			var prev *mycloud.MyCloud
+
+			for i, l := range test.logins {
+				mc, err := p.Login(l.username, l.password)
+
+				if (err != nil) != l.err {
+					t.Fatalf("login %d: unexpected error %v", i, err)
+				}
+
+				if l.same != (mc != nil && mc == prev) {
+					t.Errorf("login %d: got session %p, previous %p", i, mc, prev)
+				}
+
+				if err == nil {
+					prev = mc
+				}
+			}
+
+			if *n != test.n {
+				t.Errorf("logged in %d times, expected %d", *n, test.n)
+			}
+		})
+	}
+}
+
+func TestLoginConcurrent(t *testing.T) {
+	p, n := fakePool()
+
+	release := make(chan struct{})
+	connect := p.connect
+	p.connect = func(username string, password string) (*mycloud.MyCloud, error) {
+		<-release
+		return connect(username, password)
+	}
+
+	var wg sync.WaitGroup
+
+	results := make([]*mycloud.MyCloud, 10)
+
+	for i := range results {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			mc, err := p.Login("alice", "secret")
+			if err != nil {
+				t.Error(err)
+			}
+
+			results[i] = mc
+		}(i)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if *n != 1 {
+		t.Errorf("logged in %d times, expected 1", *n)
+	}
+
+	for i, mc := range results {
+		if mc != results[0] {
+			t.Errorf("login %d returned session %p, expected %p", i, mc, results[0])
+		}
+	}
+}
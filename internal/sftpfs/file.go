@@ -0,0 +1,101 @@
+package sftpfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/virvum/scmc/internal/drive"
+)
+
+// reader is a file opened for reading. Since SFTP clients request blocks in
+// parallel, which arrive slightly out of order, data is requested from
+// myCloud in chunks of at least ReadAhead bytes and served from a buffer.
+type reader struct {
+	*drive.Reader
+	path string
+}
+
+// ReadAt reads len(p) bytes at off.
+func (r reader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		log.Error("reading %s at %d: %v", r.path, off, err)
+		return n, mapError(err)
+	}
+
+	return n, err
+}
+
+// writer is a file opened for writing, which is kept in a local spool file
+// until it is closed.
+type writer struct {
+	fs    *FS
+	path  string
+	spool *os.File
+
+	mu     sync.Mutex
+	size   int64
+	dirty  bool
+	failed bool
+}
+
+// WriteAt writes p to the spool file at off.
+func (w *writer) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.spool.WriteAt(p, off)
+	if err != nil {
+		log.Error("writing spool file of %s: %v", w.path, err)
+		return n, err
+	}
+
+	if end := off + int64(n); end > w.size {
+		w.size = end
+	}
+
+	w.dirty = true
+
+	return n, nil
+}
+
+// TransferError is called if the connection is lost while the file is open,
+// in which case the file is not uploaded.
+func (w *writer) TransferError(err error) {
+	w.mu.Lock()
+	w.failed = true
+	w.mu.Unlock()
+
+	log.Warn("upload of %s aborted: %v", w.path, err)
+}
+
+// Close uploads the spool file if it has been modified and removes it.
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.discard()
+
+	if !w.dirty || w.failed {
+		return nil
+	}
+
+	if err := w.fs.mc.CreateFile(w.path, io.NewSectionReader(w.spool, 0, w.size)); err != nil {
+		log.Error("uploading %s: %v", w.path, err)
+		return mapError(err)
+	}
+
+	w.fs.cache.Invalidate(path.Dir(w.path))
+
+	return nil
+}
+
+// discard closes and removes the spool file.
+func (w *writer) discard() {
+	w.spool.Close()
+
+	if err := os.Remove(w.spool.Name()); err != nil {
+		log.Error("removing spool file: %v", err)
+	}
+}
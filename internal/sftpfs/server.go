@@ -0,0 +1,357 @@
+package sftpfs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/virvum/scmc/internal/sessions"
+	"github.com/virvum/scmc/pkg/logger"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var log logger.Log
+
+// Account is a myCloud account which may log in using the keys assigned to
+// it in the authorized keys file.
+type Account struct {
+	Username string
+	Password string
+	ReadOnly bool
+}
+
+// Options represents options of the SFTP server.
+type Options struct {
+	// HostKeyFile is the PEM encoded private host key, which is generated if
+	// it does not exist.
+	HostKeyFile string
+	// AuthorizedKeysFile lists the public keys which may log in, each of
+	// which has to be assigned to an account with the option
+	// account="<username>".
+	AuthorizedKeysFile string
+	// Accounts are the accounts which may log in.
+	Accounts []Account
+	// FS are the options of the file system of each connection. ReadOnly is
+	// set for accounts which are restricted to read operations.
+	FS FSOptions
+}
+
+// Server represents an SFTP server.
+type Server struct {
+	o        Options
+	config   *ssh.ServerConfig
+	accounts map[string]Account
+	sessions *sessions.Pool
+
+	mu    sync.Mutex
+	keys  map[string][]string
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer creates an SFTP server.
+func NewServer(l logger.Log, o Options) (*Server, error) {
+	log = l
+
+	s := &Server{
+		o:        o,
+		accounts: make(map[string]Account),
+		sessions: sessions.New(l),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	for _, a := range o.Accounts {
+		s.accounts[a.Username] = a
+	}
+
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: s.authenticate,
+		ServerVersion:     "SSH-2.0-scmc",
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			if err != nil && method != "none" {
+				log.Debug("%s authentication of %s from %s failed: %v", method, conn.User(), conn.RemoteAddr(), err)
+			}
+		},
+	}
+
+	key, err := loadHostKey(o.HostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s.config.AddHostKey(key)
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadHostKey loads the host key from fn, generating an ECDSA key if the
+// file does not exist.
+func loadHostKey(fn string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("ecdsa.GenerateKey: %v", err)
+		}
+
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("x509.MarshalECPrivateKey: %v", err)
+		}
+
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+		if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+			return nil, fmt.Errorf("ioutil.WriteFile(%s): %v", fn, err)
+		}
+
+		log.Info("generated host key %s", fn)
+	} else if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile(%s): %v", fn, err)
+	}
+
+	key, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("ssh.ParsePrivateKey(%s): %v", fn, err)
+	}
+
+	log.Info("host key fingerprint: %s", ssh.FingerprintSHA256(key.PublicKey()))
+
+	return key, nil
+}
+
+// Reload reloads the authorized keys file. Keys which are not assigned to a
+// configured account are skipped.
+func (s *Server) Reload() error {
+	data, err := ioutil.ReadFile(s.o.AuthorizedKeysFile)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadFile(%s): %v", s.o.AuthorizedKeysFile, err)
+	}
+
+	keys := make(map[string][]string)
+
+	for len(bytes.TrimSpace(data)) > 0 {
+		// Invalid lines are skipped, like by OpenSSH, hence an error means
+		// that the remaining lines contain no valid key.
+		key, _, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			log.Warn("%s: skipping remaining lines: %v", s.o.AuthorizedKeysFile, err)
+			break
+		}
+
+		data = rest
+
+		username := accountOption(options)
+
+		if _, ok := s.accounts[username]; !ok {
+			if username == "" {
+				log.Warn("%s: key %s is not assigned to an account, skipping", s.o.AuthorizedKeysFile, ssh.FingerprintSHA256(key))
+			} else {
+				log.Warn("%s: account %s of key %s is not configured, skipping", s.o.AuthorizedKeysFile, username, ssh.FingerprintSHA256(key))
+			}
+
+			continue
+		}
+
+		k := string(key.Marshal())
+		keys[k] = append(keys[k], username)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	log.Info("loaded %d authorized keys from %s", len(keys), s.o.AuthorizedKeysFile)
+
+	return nil
+}
+
+// accountOption returns the value of the option account="<username>".
+func accountOption(options []string) string {
+	for _, o := range options {
+		if !strings.HasPrefix(o, "account=") {
+			continue
+		}
+
+		v := strings.TrimPrefix(o, "account=")
+
+		if u, err := strconv.Unquote(v); err == nil {
+			return u
+		}
+
+		return v
+	}
+
+	return ""
+}
+
+// authenticate checks whether key is authorized. If the key is assigned to
+// several accounts, the SSH username selects the account.
+func (s *Server) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	usernames := s.keys[string(key.Marshal())]
+	s.mu.Unlock()
+
+	var username string
+
+	for _, u := range usernames {
+		if u == conn.User() {
+			username = u
+		}
+	}
+
+	if username == "" && len(usernames) == 1 {
+		username = usernames[0]
+	}
+
+	if username == "" {
+		return nil, fmt.Errorf("key %s is not authorized", ssh.FingerprintSHA256(key))
+	}
+
+	return &ssh.Permissions{Extensions: map[string]string{"account": username}}, nil
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warn("l.Accept: %v", err)
+				continue
+			}
+
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+
+			s.handle(c)
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes all connections and waits until they are finished. Files
+// which are being written are not uploaded.
+func (s *Server) Close() {
+	s.mu.Lock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// handle serves an SSH connection.
+func (s *Server) handle(c net.Conn) {
+	defer c.Close()
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, s.config)
+	if err != nil {
+		log.Info("SSH handshake with %s failed: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	a := s.accounts[conn.Permissions.Extensions["account"]]
+
+	mc, err := s.sessions.Login(a.Username, a.Password)
+	if err != nil {
+		log.Error("login of %s failed: %v", a.Username, err)
+		return
+	}
+
+	o := s.o.FS
+	o.ReadOnly = o.ReadOnly || a.ReadOnly
+	fs := NewFS(mc, o)
+
+	log.Info("%s logged in as %s", conn.RemoteAddr(), a.Username)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			log.Error("nc.Accept: %v", err)
+			continue
+		}
+
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+			s.session(fs, ch, creqs)
+		}()
+	}
+
+	log.Info("%s (%s) disconnected", conn.RemoteAddr(), a.Username)
+}
+
+// session serves the SFTP subsystem on a session channel. All other
+// requests (shells, commands, ...) are rejected.
+func (s *Server) session(fs *FS, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		var subsystem struct{ Name string }
+
+		ok := req.Type == "subsystem" && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+
+		if !ok {
+			continue
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		server := sftp.NewRequestServer(ch, fs.Handlers())
+
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Warn("SFTP session ended: %v", err)
+		}
+
+		server.Close()
+
+		return
+	}
+}
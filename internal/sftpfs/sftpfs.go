@@ -0,0 +1,341 @@
+// Package sftpfs implements an SFTP server which maps the myCloud Drive of
+// each authenticated user, using golang.org/x/crypto/ssh and the request
+// server of github.com/pkg/sftp.
+package sftpfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/virvum/scmc/internal/drive"
+	"github.com/virvum/scmc/pkg/mycloud"
+
+	"github.com/pkg/sftp"
+)
+
+// FS implements the handlers of the SFTP request server on top of a myCloud
+// session.
+type FS struct {
+	mc    *mycloud.MyCloud
+	o     FSOptions
+	cache *drive.Cache
+}
+
+// FSOptions represents options of a file system.
+type FSOptions struct {
+	// ListTTL is the duration for which directory listings are cached.
+	ListTTL time.Duration
+	// ReadAhead is the minimum number of bytes requested from myCloud when
+	// reading a file.
+	ReadAhead int64
+	// SpoolDir is the directory in which files are stored while they are
+	// written.
+	SpoolDir string
+	// ReadOnly rejects all modifications.
+	ReadOnly bool
+}
+
+// NewFS creates a file system backed by the given myCloud session.
+func NewFS(mc *mycloud.MyCloud, o FSOptions) *FS {
+	return &FS{
+		mc:    mc,
+		o:     o,
+		cache: drive.NewCache(mc, o.ListTTL),
+	}
+}
+
+// Handlers returns the handlers of the SFTP request server.
+func (f *FS) Handlers() sftp.Handlers {
+	return sftp.Handlers{
+		FileGet:  f,
+		FilePut:  f,
+		FileCmd:  f,
+		FileList: f,
+	}
+}
+
+// stat returns the entry of the cleaned path p.
+func (f *FS) stat(p string) (*drive.Entry, error) {
+	e, err := f.cache.Stat(p)
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	return e, nil
+}
+
+// parent checks whether the parent directory of p exists, since myCloud
+// creates missing parents, which SFTP clients do not expect.
+func (f *FS) parent(p string) error {
+	return mapError(f.cache.Parent(p))
+}
+
+// Fileread opens a file for reading.
+func (f *FS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	fi, err := f.stat(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Dir {
+		return nil, sftp.ErrSSHFxFailure
+	}
+
+	return reader{drive.NewReader(f.mc, r.Filepath, fi.Size, f.o.ReadAhead), r.Filepath}, nil
+}
+
+// Filewrite opens a file for writing. Since SFTP clients write blocks in
+// parallel and myCloud only stores whole files, the file is spooled locally
+// and uploaded when it is closed. Existing files are downloaded first unless
+// they are truncated.
+func (f *FS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if f.o.ReadOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	var (
+		flags   = r.Pflags()
+		fi, err = f.stat(r.Filepath)
+	)
+
+	switch {
+	case err == nil && fi.Dir:
+		return nil, sftp.ErrSSHFxFailure
+	case err == nil && flags.Creat && flags.Excl:
+		return nil, os.ErrExist
+	case err == sftp.ErrSSHFxNoSuchFile && !flags.Creat:
+		return nil, err
+	case err != nil && err != sftp.ErrSSHFxNoSuchFile:
+		return nil, err
+	}
+
+	if err := f.parent(r.Filepath); err != nil {
+		return nil, err
+	}
+
+	spool, err := ioutil.TempFile(f.o.SpoolDir, "scmc-*.spool")
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.TempFile: %v", err)
+	}
+
+	w := &writer{fs: f, path: r.Filepath, spool: spool}
+
+	if fi != nil && !flags.Trunc {
+		if err := f.mc.GetFile(r.Filepath, spool, ""); err != nil {
+			w.discard()
+			return nil, mapError(err)
+		}
+
+		w.size = fi.Size
+	} else {
+		// Files are created when they are opened, even if nothing is written.
+		w.dirty = true
+	}
+
+	return w, nil
+}
+
+// Filecmd handles commands which modify the file system.
+func (f *FS) Filecmd(r *sftp.Request) error {
+	if r.Method == "Setstat" {
+		// Neither permissions nor timestamps can be set on myCloud, but
+		// clients preserving them should not fail.
+		return nil
+	}
+
+	if f.o.ReadOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	switch r.Method {
+	case "Mkdir":
+		return f.mkdir(r.Filepath)
+	case "Rmdir":
+		return f.remove(r.Filepath, true)
+	case "Remove":
+		return f.remove(r.Filepath, false)
+	case "Rename":
+		return f.rename(r.Filepath, r.Target)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// mkdir creates a directory.
+func (f *FS) mkdir(p string) error {
+	if _, err := f.stat(p); err == nil {
+		return os.ErrExist
+	} else if err != sftp.ErrSSHFxNoSuchFile {
+		return err
+	}
+
+	if err := f.parent(p); err != nil {
+		return err
+	}
+
+	if err := f.mc.CreateDirectory(drive.DirPath(p)); err != nil {
+		return mapError(err)
+	}
+
+	f.cache.Invalidate(path.Dir(p))
+
+	return nil
+}
+
+// remove removes a file or an empty directory.
+func (f *FS) remove(p string, dir bool) error {
+	if p == "/" {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	fi, err := f.stat(p)
+	if err != nil {
+		return err
+	}
+
+	if fi.Dir != dir {
+		return sftp.ErrSSHFxFailure
+	}
+
+	target := p
+
+	if dir {
+		f.cache.Invalidate(p)
+
+		entries, err := f.cache.List(p)
+		if err != nil {
+			return mapError(err)
+		}
+
+		// myCloud removes directories recursively.
+		if len(entries) > 0 {
+			return fmt.Errorf("directory not empty")
+		}
+
+		target = drive.DirPath(p)
+	}
+
+	if err := f.mc.Delete([]string{target}); err != nil {
+		return mapError(err)
+	}
+
+	f.cache.Invalidate(path.Dir(p))
+	f.cache.Forget(p)
+
+	return nil
+}
+
+// rename moves a file or directory. Existing targets are not replaced, as
+// required by the SFTP protocol.
+func (f *FS) rename(src string, dst string) error {
+	if src == "/" || dst == "/" || strings.HasPrefix(dst, drive.DirPath(src)) {
+		return sftp.ErrSSHFxFailure
+	}
+
+	fi, err := f.stat(src)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.stat(dst); err == nil {
+		return os.ErrExist
+	} else if err != sftp.ErrSSHFxNoSuchFile {
+		return err
+	}
+
+	if err := f.parent(dst); err != nil {
+		return err
+	}
+
+	if fi.Dir {
+		err = drive.MoveDir(f.mc, src, dst)
+	} else {
+		err = f.mc.Move(src, dst)
+	}
+
+	f.cache.Invalidate(path.Dir(src), path.Dir(dst))
+	f.cache.Forget(src)
+	f.cache.Forget(dst)
+
+	return mapError(err)
+}
+
+// Filelist lists directories and stats files.
+func (f *FS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		fi, err := f.stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+
+		if !fi.Dir {
+			return nil, sftp.ErrSSHFxFailure
+		}
+
+		entries, err := f.cache.List(r.Filepath)
+		if err != nil {
+			return nil, mapError(err)
+		}
+
+		l := make(lister, 0, len(entries))
+
+		for _, e := range entries {
+			l = append(l, e.Info())
+		}
+
+		sort.Slice(l, func(i, j int) bool { return l[i].Name() < l[j].Name() })
+
+		return l, nil
+	case "Stat":
+		fi, err := f.stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+
+		return lister{fi.Info()}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// mapError maps errors returned by the myCloud API to SFTP status codes.
+func mapError(err error) error {
+	if err == os.ErrNotExist {
+		return sftp.ErrSSHFxNoSuchFile
+	}
+
+	switch mycloud.StatusCode(err) {
+	case http.StatusNotFound:
+		return sftp.ErrSSHFxNoSuchFile
+	case http.StatusForbidden:
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	return err
+}
+
+// lister implements sftp.ListerAt.
+type lister []os.FileInfo
+
+// ListAt copies the entries starting at offset to ls.
+func (l lister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,204 @@
+// Package tlsconfig provides the TLS configuration for the servers offered by scmc.
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/virvum/scmc/pkg/logger"
+)
+
+// Validity of generated self-signed certificates.
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// Options represents the TLS options of a server.
+type Options struct {
+	CertFile   string
+	KeyFile    string
+	ClientCA   string
+	SelfSigned bool
+	Hosts      []string
+}
+
+// Enabled returns true if TLS has been requested by the given options. A
+// client CA alone enables TLS as well, so that New rejects it instead of
+// serving without client certificate authentication.
+func (o Options) Enabled() bool {
+	return o.CertFile != "" || o.KeyFile != "" || o.ClientCA != "" || o.SelfSigned
+}
+
+// Config holds the currently loaded server certificate.
+type Config struct {
+	options Options
+	log     logger.Log
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+}
+
+// New creates a TLS configuration from the given options. If a self-signed
+// certificate was requested and the certificate file does not exist yet, a
+// new certificate and key are generated and written to the given paths.
+func New(o Options, l logger.Log) (*Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		if o.ClientCA != "" {
+			return nil, fmt.Errorf("client certificate authentication requires a certificate and a key file")
+		}
+
+		return nil, fmt.Errorf("both a certificate and a key file must be specified")
+	}
+
+	c := &Config{
+		options: o,
+		log:     l,
+	}
+
+	if o.SelfSigned {
+		if _, err := os.Stat(o.CertFile); os.IsNotExist(err) {
+			if err := generateSelfSigned(o.CertFile, o.KeyFile, o.Hosts); err != nil {
+				return nil, fmt.Errorf("generateSelfSigned: %v", err)
+			}
+
+			c.log.Info("generated self-signed certificate %s", o.CertFile)
+		}
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload (re-)reads the certificate and key files. The previously loaded
+// certificate stays in use if loading fails.
+func (c *Config) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.options.CertFile, c.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls.LoadX509KeyPair(%s, %s): %v", c.options.CertFile, c.options.KeyFile, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	c.log.Info("loaded certificate %s", c.options.CertFile)
+
+	return nil
+}
+
+func (c *Config) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// TLSConfig returns a tls.Config which always serves the most recently loaded
+// certificate. If a client CA bundle was given, clients are required to
+// present a certificate signed by one of its CAs.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	t := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}
+
+	if c.options.ClientCA != "" {
+		data, err := ioutil.ReadFile(c.options.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("ioutil.ReadFile(%s): %v", c.options.ClientCA, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", c.options.ClientCA)
+		}
+
+		t.ClientCAs = pool
+		t.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return t, nil
+}
+
+// generateSelfSigned creates a self-signed ECDSA certificate valid for the given hosts.
+func generateSelfSigned(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("ecdsa.GenerateKey: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("rand.Int: %v", err)
+	}
+
+	now := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"scmc"}, CommonName: "scmc"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, h := range append([]string{"localhost", "127.0.0.1", "::1"}, hosts...) {
+		if h == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("x509.CreateCertificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("x509.MarshalECPrivateKey: %v", err)
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(fn string, blockType string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile(%s): %v", fn, err)
+	}
+
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: data}); err != nil {
+		f.Close()
+		return fmt.Errorf("pem.Encode(%s): %v", fn, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close(%s): %v", fn, err)
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,6 +14,7 @@ import (
 	"net/http/httputil"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/virvum/scmc/pkg/logger"
 )
@@ -26,10 +28,49 @@ const (
 
 var log logger.Log
 
+// RequestHook is called after each request to myCloud with the request
+// method and action, the status code of the response (0 if none was
+// received), the duration of the request and the error returned by Request.
+// If the response is returned to the caller, reading its body is not included
+// in the duration.
+type RequestHook func(method string, action string, status int, d time.Duration, err error)
+
+// Option represents an option of a myCloud instance.
+type Option func(mc *MyCloud)
+
+// WithRequestHook sets a hook which is called after each request.
+func WithRequestHook(h RequestHook) Option {
+	return func(mc *MyCloud) {
+		mc.requestHook = h
+	}
+}
+
+// StatusError is returned if myCloud responds with an unexpected status code.
+type StatusError struct {
+	Code     int
+	Expected int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got status code %d (expected %d)", e.Code, e.Expected)
+}
+
+// StatusCode returns the status code of the StatusError wrapped by err, or 0
+// if there is none.
+func StatusCode(err error) int {
+	var se *StatusError
+
+	if errors.As(err, &se) {
+		return se.Code
+	}
+
+	return 0
+}
+
 // TODO automatically re-authenticate, when token isn't valid anymore
 
 // New creates a new myCloud instance. This function will automatically authenticate the given user.
-func New(username string, password string, l logger.Log) (*MyCloud, error) {
+func New(username string, password string, l logger.Log, options ...Option) (*MyCloud, error) {
 	log = l
 
 	jar, err := cookiejar.New(nil)
@@ -47,6 +88,10 @@ func New(username string, password string, l logger.Log) (*MyCloud, error) {
 		},
 	}
 
+	for _, o := range options {
+		o(mc)
+	}
+
 	if err := mc.authenticate(username, password); err != nil {
 		return mc, fmt.Errorf("mc.authenticate: %v", err)
 	}
@@ -56,8 +101,18 @@ func New(username string, password string, l logger.Log) (*MyCloud, error) {
 
 // Request is used to access a myCloud resource in a generic way.
 // Important: response.Body.Close() required, when r.Result is not set.
-func (mc *MyCloud) Request(r Request) error {
-	client := &http.Client{}
+func (mc *MyCloud) Request(r Request) (err error) {
+	var (
+		client = &http.Client{}
+		start  = time.Now()
+		status int
+	)
+
+	if mc.requestHook != nil {
+		defer func() {
+			mc.requestHook(r.Method, r.Action, status, time.Since(start), err)
+		}()
+	}
 
 	request, err := http.NewRequest(r.Method, r.Server+"/"+r.Action, r.Reader)
 	if err != nil {
@@ -109,9 +164,11 @@ func (mc *MyCloud) Request(r Request) error {
 
 	response, err := client.Do(request)
 	if err != nil {
-		return fmt.Errorf("client.Do: %v", err)
+		return fmt.Errorf("client.Do: %w", err)
 	}
 
+	status = response.StatusCode
+
 	if log.IsDebug() {
 		requestDump, err := httputil.DumpResponse(response, log.IsTrace())
 		if err != nil {
@@ -136,7 +193,7 @@ func (mc *MyCloud) Request(r Request) error {
 			}
 		}
 
-		return fmt.Errorf("got status code %d instead of 200", response.StatusCode)
+		return &StatusError{Code: response.StatusCode, Expected: http.StatusOK}
 	}
 
 	if r.Result != nil {
@@ -171,7 +228,7 @@ func (mc *MyCloud) Identity() (*IdentityResponse, error) {
 		Action: "me",
 		Result: &r,
 	}); err != nil {
-		return nil, fmt.Errorf("mc.Request: %v", err)
+		return nil, fmt.Errorf("mc.Request: %w", err)
 	}
 
 	return &r, nil
@@ -187,7 +244,7 @@ func (mc *MyCloud) Usage() (*UsageResponse, error) {
 		Action: "usage",
 		Result: &r,
 	}); err != nil {
-		return nil, fmt.Errorf("mc.Request: %v", err)
+		return nil, fmt.Errorf("mc.Request: %w", err)
 	}
 
 	return &r, nil
@@ -204,7 +261,7 @@ func (mc *MyCloud) Metadata(path string) (*MetadataResponse, error) {
 		Path:   path,
 		Result: &r,
 	}); err != nil {
-		return nil, fmt.Errorf("mc.Request: %v", err)
+		return nil, fmt.Errorf("mc.Request: %w", err)
 	}
 
 	return &r, nil
@@ -225,7 +282,7 @@ func (mc *MyCloud) CreateDirectory(path string) error {
 		Path:   path,
 		Result: &r,
 	}); err != nil {
-		return fmt.Errorf("mc.Request: %v", err)
+		return fmt.Errorf("mc.Request: %w", err)
 	}
 
 	if r.Name != filepath.Base(path) {
@@ -259,7 +316,7 @@ func (mc *MyCloud) Delete(paths []string) error {
 		Reader: bytes.NewBuffer(reqJSON),
 		Result: &r,
 	}); err != nil {
-		return fmt.Errorf("mc.Request: %v", err)
+		return fmt.Errorf("mc.Request: %w", err)
 	}
 
 	// We trust myCloud (sigh...)
@@ -284,7 +341,7 @@ func (mc *MyCloud) CreateFile(path string, dataReader io.Reader) error {
 		ContentType: "application/octet-stream",
 		Result:      &r,
 	}); err != nil {
-		return fmt.Errorf("mc.Request: %v", err)
+		return fmt.Errorf("mc.Request: %w", err)
 	}
 
 	if r.Name != filepath.Base(path) {
@@ -294,9 +351,10 @@ func (mc *MyCloud) CreateFile(path string, dataReader io.Reader) error {
 	return nil
 }
 
-// GetFile downloads a file.
-// TODO replace httpRange with a httpRange range type
-func (mc *MyCloud) GetFile(path string, dataWriter io.Writer, httpRange string) error {
+// OpenFile requests a file and returns the response without checking its
+// status code, so that callers can distinguish missing files (404) and
+// unsatisfiable ranges (416). The response body must be closed by the caller.
+func (mc *MyCloud) OpenFile(path string, httpRange string) (*http.Response, error) {
 	var response *http.Response
 
 	if err := mc.Request(Request{
@@ -307,7 +365,18 @@ func (mc *MyCloud) GetFile(path string, dataWriter io.Writer, httpRange string)
 		HTTPRange: httpRange,
 		Response:  &response,
 	}); err != nil {
-		return fmt.Errorf("mc.Request: %v", err)
+		return nil, fmt.Errorf("mc.Request: %w", err)
+	}
+
+	return response, nil
+}
+
+// GetFile downloads a file.
+// TODO replace httpRange with a httpRange range type
+func (mc *MyCloud) GetFile(path string, dataWriter io.Writer, httpRange string) error {
+	response, err := mc.OpenFile(path, httpRange)
+	if err != nil {
+		return fmt.Errorf("mc.OpenFile: %w", err)
 	}
 
 	defer response.Body.Close()
@@ -315,15 +384,37 @@ func (mc *MyCloud) GetFile(path string, dataWriter io.Writer, httpRange string)
 	if httpRange != "" {
 		if response.StatusCode != 206 {
 			// TODO output response body
-			return fmt.Errorf("got status code %d (expected 206)", response.StatusCode)
+			return &StatusError{Code: response.StatusCode, Expected: http.StatusPartialContent}
 		}
 	} else if response.StatusCode != 200 {
 		// TODO output response body
-		return fmt.Errorf("got status code %d (expected 200)", response.StatusCode)
+		return &StatusError{Code: response.StatusCode, Expected: http.StatusOK}
 	}
 
 	if _, err := io.Copy(dataWriter, response.Body); err != nil {
-		return fmt.Errorf("io.Copy: %v", err)
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+
+	return nil
+}
+
+// Move moves a file. Since there is no API call to move files, the file is
+// streamed from src to dst (without being stored locally) and src is deleted
+// afterwards.
+func (mc *MyCloud) Move(src string, dst string) error {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(mc.GetFile(src, pw, ""))
+	}()
+
+	if err := mc.CreateFile(dst, pr); err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("mc.CreateFile: %w", err)
+	}
+
+	if err := mc.Delete([]string{src}); err != nil {
+		return fmt.Errorf("mc.Delete: %w", err)
 	}
 
 	return nil
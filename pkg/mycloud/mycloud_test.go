@@ -0,0 +1,41 @@
+package mycloud
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestStatusCode(t *testing.T) {
+	notFound := &StatusError{Code: http.StatusNotFound, Expected: http.StatusOK}
+
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"nil", nil, 0},
+		{"status error", notFound, http.StatusNotFound},
+		{"wrapped", fmt.Errorf("mc.Metadata(/foo/): %w", notFound), http.StatusNotFound},
+		{"wrapped twice", fmt.Errorf("move: %w", fmt.Errorf("mc.Move(/foo): %w", notFound)), http.StatusNotFound},
+		{"formatted", fmt.Errorf("mc.Metadata(/foo/): %v", notFound), 0},
+		{"message only", errors.New("got status code 404 (expected 200)"), 0},
+		{"other error", os.ErrNotExist, 0},
+	}
+
+	for _, test := range tests {
+		if code := StatusCode(test.err); code != test.code {
+			t.Errorf("%s: StatusCode(%v) = %d, expected %d", test.name, test.err, code, test.code)
+		}
+	}
+}
+
+func TestStatusErrorMessage(t *testing.T) {
+	err := &StatusError{Code: http.StatusConflict, Expected: http.StatusCreated}
+
+	if s := err.Error(); s != "got status code 409 (expected 201)" {
+		t.Errorf("unexpected message %q", s)
+	}
+}
@@ -11,6 +11,7 @@ type MyCloud struct {
 	client      *http.Client
 	authState   map[string]interface{}
 	accessToken string
+	requestHook RequestHook
 }
 
 // Request represents request options.
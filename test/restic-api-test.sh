@@ -0,0 +1,113 @@
+#!/bin/sh
+#
+# Checks the responses of "scmc restic-rest-server" against the restic REST
+# backend specification (API versions 1 and 2):
+#
+# https://restic.readthedocs.io/en/stable/100_references.html#rest-backend
+
+set -e
+
+config="$HOME"/.scmc.yaml
+username=$(python -c "import yaml; print(yaml.safe_load(open('$config'))['username'])")
+password=$(python -c "import yaml; print(yaml.safe_load(open('$config'))['password'])")
+address=127.0.0.1:9001
+api_url="http://$username:$password@$address"
+repo=/restic-api-test-$(basename $(mktemp --dry-run))
+
+v1=application/vnd.x.restic.rest.v1
+v2=application/vnd.x.restic.rest.v2
+bin=application/octet-stream
+
+scmc restic-rest-server --address $address &
+scmcpid=$!
+
+cleanup() {
+	curl -s -o /dev/null -XDELETE "$api_url$repo/"
+	kill $scmcpid
+	rm -rf "$tmpdir"
+}
+
+tmpdir=$(mktemp -d)
+trap cleanup EXIT
+
+sleep 1
+
+printf 'not really a restic config' > "$tmpdir"/config
+head -c 4096 /dev/urandom > "$tmpdir"/blob
+
+blob=$(sha256sum "$tmpdir"/blob | awk '{ print $1 }')
+missing=$(printf missing | sha256sum | awk '{ print $1 }')
+
+failed=0
+
+# Each line of the table consists of the request method, the path, the Accept
+# header, the Range header, the file to send as request body, and the expected
+# status code and content type. A dash means "not set" or "not checked".
+while read -r method path accept range body status type
+do
+	case "$method" in
+	''|'#'*)
+		continue
+		;;
+	esac
+
+	set -- -s -o "$tmpdir"/response -D "$tmpdir"/headers -w '%{http_code}'
+
+	if test "$method" = HEAD
+	then
+		set -- "$@" -I
+	else
+		set -- "$@" -X "$method"
+	fi
+
+	test "$accept" != - && set -- "$@" -H "Accept: $accept"
+	test "$range" != - && set -- "$@" -H "Range: $range"
+	test "$body" != - && set -- "$@" --data-binary @"$tmpdir/$body"
+
+	got_status=$(curl "$@" "$api_url$path")
+	got_type=$(grep -i '^content-type:' "$tmpdir"/headers | cut -d: -f2 | tr -d ' \r' | cut -d';' -f1)
+
+	if test "$got_status" != "$status" || { test "$type" != - && test "$got_type" != "$type"; }
+	then
+		echo "FAIL: $method $path (accept: $accept, range: $range): got $got_status $got_type, expected $status $type" >&2
+		failed=$((failed + 1))
+	else
+		echo "ok:   $method $path (accept: $accept, range: $range): $got_status $got_type" >&2
+	fi
+done <<EOF
+# method path                    accept range          body   status type
+POST     $repo/?create=false      -      -              -      400    -
+POST     $repo/?create=true       -      -              -      200    -
+POST     $repo/?create=true       -      -              -      200    -
+HEAD     $repo/config             -      -              -      404    -
+GET      $repo/config             -      -              -      404    -
+POST     $repo/config             -      -              config 200    -
+POST     $repo/?create=true       -      -              -      409    -
+HEAD     $repo/config             -      -              -      200    -
+GET      $repo/config             -      -              -      200    $bin
+POST     $repo/data/$blob         -      -              blob   200    -
+POST     $repo/data/$missing      -      -              blob   400    -
+HEAD     $repo/data/$blob         -      -              -      200    -
+HEAD     $repo/data/$missing      -      -              -      404    -
+GET      $repo/data/$blob         -      -              -      200    $bin
+GET      $repo/data/$blob         -      bytes=0-99     -      206    $bin
+GET      $repo/data/$blob         -      bytes=4000-    -      206    $bin
+GET      $repo/data/$blob         -      bytes=100000-  -      416    -
+GET      $repo/data/$missing      -      -              -      404    -
+GET      $repo/data/              $v1    -              -      200    $v1
+GET      $repo/data/              $v2    -              -      200    $v2
+GET      $repo/keys/              $v1    -              -      200    $v1
+GET      $repo/keys/              $v2    -              -      200    $v2
+GET      $repo/snapshots/         -      -              -      200    $v1
+PUT      $repo/config             -      -              config 405    -
+DELETE   $repo/data/$blob         -      -              -      200    -
+GET      $repo/data/$blob         -      -              -      404    -
+EOF
+
+if test $failed -gt 0
+then
+	echo "$failed checks failed." >&2
+	exit 1
+fi
+
+echo 'All checks passed.' >&2